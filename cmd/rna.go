@@ -5,13 +5,50 @@ import (
 	"fmt"
 	"github.com/adrian-bl/rna/lib/cache"
 	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/dnssec"
+	"github.com/adrian-bl/rna/lib/hints"
 	l "github.com/adrian-bl/rna/lib/log"
 	"github.com/adrian-bl/rna/lib/packet"
 	"github.com/adrian-bl/rna/lib/queue"
+	"github.com/adrian-bl/rna/lib/zone"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var listenPort = flag.Int("port", 53, "Bind to this port, defaults to 53")
+var ednsSize = flag.Int("edns-size", constants.DEFAULT_SIZE_EDNS, "EDNS(0) UDP payload size to advertise")
+var validate = flag.Bool("dnssec", false, "Validate replies using DNSSEC")
+var nsFamily = flag.String("ns-family", "prefer-ipv4", "Address family used to contact nameservers: ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
+var rootHints = flag.String("root-hints", "", "Read root hints from this file (named.root format) instead of using the built-in list")
+var trustAnchor = flag.String("trust-anchor", "", "Read root DS records from this file instead of using the built-in anchors")
+var cacheSize = flag.Int("cache-size", constants.CACHE_MAX_BYTES>>20, "Memory limit of the cache in MiB, 0 for no limit")
+var cacheEntries = flag.Int("cache-entries", constants.CACHE_MAX_ENTRIES, "Max. number of cached RRsets, 0 for no limit")
+var cachePolicy = flag.String("cache-policy", "lru", "Which entries to evict if the cache is full: lru or lfu")
+var serveStale = flag.Duration("serve-stale", 0, "Keep expired cache entries this long and answer with them if resolving fails (RFC 8767), e.g. 24h. 0 disables serve-stale")
+var cacheFile = flag.String("cache-file", "", "Restore the cache from this file on startup and save it there periodically and on shutdown")
+var forwardZones, stubZones, localZones zoneFlags
+
+// zoneFlags collects the values of a repeatable flag
+type zoneFlags []string
+
+func (z *zoneFlags) String() string {
+	return strings.Join(*z, " ")
+}
+
+func (z *zoneFlags) Set(s string) error {
+	*z = append(*z, s)
+	return nil
+}
+
+func init() {
+	flag.Var(&forwardZones, "forward", "Forward queries for a zone to other resolvers: zone=ip[,ip...], may be repeated")
+	flag.Var(&stubZones, "stub", "Use these authoritative servers for a zone: zone=ip[,ip...], may be repeated")
+	flag.Var(&localZones, "local-zone", "Answer queries for a zone from a master file: zone=path, may be repeated")
+}
 
 func main() {
 	flag.Parse()
@@ -28,9 +65,47 @@ func main() {
 		l.Panic("listen failed: %v", err)
 	}
 
+	tcpAddr, err := net.ResolveTCPAddr("tcp", listenStr)
+	if err != nil {
+		l.Panic("ResolveTCPAddr failed: %v", err)
+	}
+	tlistener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		l.Panic("tcp listen failed: %v", err)
+	}
+
 	nc := cache.NewNameCache()
+	nc.SetLimits(*cacheSize<<20, *cacheEntries, parseEvictionPolicy(*cachePolicy))
+	nc.SetStaleWindow(*serveStale)
+	nc.StartSweeper(constants.CACHE_SWEEP_INTERVAL)
+	if *cacheFile != "" {
+		restoreCache(nc, *cacheFile)
+		go saveCache(nc, *cacheFile)
+	}
 	sq := queue.NewServerQueue(nc)
-	cq := queue.NewClientQueue(rconn, nc, sq)
+	cq := queue.NewClientQueue(nc, sq)
+	cq.SetEdnsSize(*ednsSize)
+	cq.SetAddressFamily(parseAddressFamily(*nsFamily))
+	if *rootHints != "" {
+		cq.SetRootHints(loadRootHints(*rootHints))
+	}
+	if *validate {
+		cq.EnableValidation(loadTrustAnchors(*trustAnchor))
+	}
+	for _, fwd := range forwardZones {
+		zone, servers := parseZoneServers(fwd)
+		cq.AddForwardZone(zone, servers)
+	}
+	for _, stub := range stubZones {
+		zone, servers := parseZoneServers(stub)
+		cq.AddStubZone(zone, servers)
+	}
+	for _, local := range localZones {
+		cq.AddLocalZone(loadLocalZone(local))
+	}
+	cq.StartPriming()
+	go logStats(nc, sq)
+	go acceptTcpClients(cq, tlistener)
 	readClient(cq, rconn)
 }
 
@@ -43,15 +118,21 @@ func readClient(cq *queue.Cq, conn *net.UDPConn) {
 			continue
 		}
 
+		client := queue.NewUdpClient(conn, remoteAddr)
 		p, err := packet.Parse(buf[0:nread])
 		if err != nil {
 			l.Debug("%v failed to parse datagram, err=%v", remoteAddr, err)
+			if p != nil && p.Header.Response == false {
+				cq.SendError(malformedQuery(p), client, constants.RC_FORM_ERR)
+			}
 			continue
 		}
 
-		if p.Header.Response == false && p.Header.Opcode == constants.OP_QUERY && p.Header.RecDesired {
-			// This is a query, requesting recursion
-			cq.AddClientRequest(p, remoteAddr)
+		if isRecursiveQuery(p) {
+			cq.AddClientRequest(p, client)
+		} else if rcode, ok := rejectRcode(p); ok {
+			l.Info("%v rejecting query, rcode=%d", remoteAddr, rcode)
+			cq.SendError(p, client, rcode)
 		} else {
 			// DOES NOT COMPUTE.
 			l.Info("!!! %v dropped packet", remoteAddr)
@@ -59,3 +140,228 @@ func readClient(cq *queue.Cq, conn *net.UDPConn) {
 
 	}
 }
+
+func acceptTcpClients(cq *queue.Cq, listener *net.TCPListener) {
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			l.Debug("tcp accept failed: %v", err)
+			continue
+		}
+		go readTcpClient(cq, conn)
+	}
+}
+
+// readTcpClient handles all queries sent via a single TCP connection.
+// The connection is closed if the client stays idle for too long.
+func readTcpClient(cq *queue.Cq, conn *net.TCPConn) {
+	remoteAddr := conn.RemoteAddr()
+	client := queue.NewTcpClient(conn)
+	defer client.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(constants.TIMEOUT_TCP_IDLE))
+		buf, err := packet.ReadTcpFrame(conn)
+		if err != nil {
+			l.Debug("%v closing tcp connection, err=%v", remoteAddr, err)
+			break
+		}
+		if len(buf) < constants.FIX_SIZE_HEADER {
+			l.Debug("%v dropping malformed tcp message. Size=%d", remoteAddr, len(buf))
+			continue
+		}
+
+		p, err := packet.Parse(buf)
+		if err != nil {
+			l.Debug("%v failed to parse tcp message, err=%v", remoteAddr, err)
+			if p != nil && p.Header.Response == false {
+				client.Track()
+				cq.SendError(malformedQuery(p), client, constants.RC_FORM_ERR)
+			}
+			continue
+		}
+
+		if isRecursiveQuery(p) {
+			client.Track()
+			cq.AddClientRequest(p, client)
+		} else if rcode, ok := rejectRcode(p); ok {
+			l.Info("%v rejecting tcp query, rcode=%d", remoteAddr, rcode)
+			client.Track()
+			cq.SendError(p, client, rcode)
+		} else {
+			l.Info("!!! %v dropped tcp message", remoteAddr)
+		}
+	}
+}
+
+// restoreCache warms the cache using the dump in path. A missing or broken
+// dump is not fatal: we just start with an empty cache.
+func restoreCache(nc *cache.Cache, path string) {
+	n, err := nc.RestoreFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		l.Info("failed to restore cache from %s: %v", path, err)
+	}
+	if n > 0 {
+		l.Info("restored %d RRsets from %s", n, path)
+	}
+}
+
+// saveCache writes the cache to path every CACHE_SAVE_INTERVAL and
+// once more before exiting on SIGINT or SIGTERM
+func saveCache(nc *cache.Cache, path string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	tick := time.Tick(constants.CACHE_SAVE_INTERVAL)
+	for exit := false; !exit; {
+		select {
+		case <-tick:
+		case s := <-sig:
+			l.Info("received %v, saving cache", s)
+			exit = true
+		}
+		if n, err := nc.SaveFile(path); err != nil {
+			l.Info("failed to save cache to %s: %v", path, err)
+		} else {
+			l.Debug("saved %d RRsets to %s", n, path)
+		}
+	}
+	os.Exit(0)
+}
+
+// logStats logs statistics about the cache and the outstanding upstream queries every STATS_INTERVAL
+func logStats(nc *cache.Cache, sq *queue.Sq) {
+	for range time.Tick(constants.STATS_INTERVAL) {
+		cs := nc.Stats()
+		ss := sq.Stats()
+		l.Info("cache: %d RRsets, %d bytes, %d evicted, %d expired; upstream: %d pending, %d expired, %d evicted, %d mismatching replies",
+			cs.Entries, cs.Bytes, cs.Evicted, cs.Expired, ss.Pending, ss.Expired, ss.Evicted, ss.Mismatches)
+	}
+}
+
+// parseAddressFamily converts the -ns-family flag into a queue.AF_* constant
+func parseAddressFamily(s string) int {
+	switch s {
+	case "ipv4":
+		return queue.AF_ONLY_V4
+	case "ipv6":
+		return queue.AF_ONLY_V6
+	case "prefer-ipv4":
+		return queue.AF_PREFER_V4
+	case "prefer-ipv6":
+		return queue.AF_PREFER_V6
+	}
+	l.Panic("invalid address family: %s", s)
+	return 0
+}
+
+func parseEvictionPolicy(s string) int {
+	switch s {
+	case "lru":
+		return cache.EVICT_LRU
+	case "lfu":
+		return cache.EVICT_LFU
+	}
+	l.Panic("invalid cache policy: %s", s)
+	return 0
+}
+
+// loadRootHints returns the root hints stored in path
+func loadRootHints(path string) []packet.ResourceRecordFormat {
+	f, err := os.Open(path)
+	if err != nil {
+		l.Panic("failed to open root hints: %v", err)
+	}
+	defer f.Close()
+
+	rrs, err := hints.Parse(f)
+	if err != nil {
+		l.Panic("failed to parse root hints %s: %v", path, err)
+	}
+	return rrs
+}
+
+// loadTrustAnchors returns the DS records of the root zone found in path,
+// or the built-in anchors if path is empty
+func loadTrustAnchors(path string) []*dnssec.Ds {
+	if path == "" {
+		return dnssec.RootAnchors()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		l.Panic("failed to open trust anchor: %v", err)
+	}
+	defer f.Close()
+
+	anchors, err := dnssec.ParseTrustAnchors(f)
+	if err != nil {
+		l.Panic("failed to parse trust anchor %s: %v", path, err)
+	}
+	return anchors
+}
+
+// parseZoneServers parses a -forward or -stub flag such as `corp.example=10.0.0.53,[2001:db8::53]:5353'
+func parseZoneServers(s string) (packet.Namelabel, []*net.UDPAddr) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		l.Panic("invalid zone %q, expected zone=ip[,ip...]", s)
+	}
+	zone, err := packet.ParseTextName(parts[0])
+	if err != nil {
+		l.Panic("invalid zone %q: %v", s, err)
+	}
+
+	servers := make([]*net.UDPAddr, 0)
+	for _, server := range strings.Split(parts[1], ",") {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53") // no port given
+		}
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			l.Panic("invalid server %q: %v", server, err)
+		}
+		servers = append(servers, addr)
+	}
+	return zone, servers
+}
+
+// loadLocalZone parses a -local-zone flag such as `corp.example=/etc/rna/corp.zone'
+// and reads the master file it refers to
+func loadLocalZone(s string) *zone.Zone {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		l.Panic("invalid local zone %q, expected zone=path", s)
+	}
+	origin, err := packet.ParseTextName(parts[0])
+	if err != nil {
+		l.Panic("invalid local zone %q: %v", s, err)
+	}
+	z, err := zone.Load(parts[1], origin)
+	if err != nil {
+		l.Panic("failed to load zone %v: %v", &origin, err)
+	}
+	return z
+}
+
+// isRecursiveQuery returns true if p is a query, requesting recursion
+func isRecursiveQuery(p *packet.ParsedPacket) bool {
+	return p.Header.Response == false && p.Header.Opcode == constants.OP_QUERY && p.Header.RecDesired
+}
+
+// rejectRcode returns the rcode to answer a message we do not serve with.
+// Responses are never answered.
+func rejectRcode(p *packet.ParsedPacket) (uint8, bool) {
+	switch {
+	case p.Header.Response:
+		return 0, false
+	case p.Header.Opcode != constants.OP_QUERY:
+		return constants.RC_NOT_IMPL, true
+	default:
+		return constants.RC_REFUSED, true // we only do recursion
+	}
+}
+
+// malformedQuery strips everything but the header from a query we failed to parse
+func malformedQuery(p *packet.ParsedPacket) *packet.ParsedPacket {
+	return &packet.ParsedPacket{Header: packet.ParsedPacketHeader{Id: p.Header.Id, Opcode: p.Header.Opcode}}
+}
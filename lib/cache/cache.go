@@ -6,7 +6,6 @@ import (
 	l "github.com/adrian-bl/rna/lib/log"
 	"github.com/adrian-bl/rna/lib/packet"
 	"net"
-	"sync"
 	"time"
 )
 
@@ -14,27 +13,54 @@ import (
 type CacheResult struct {
 	ResourceRecord []packet.ResourceRecordFormat
 	ResponseCode   uint8
+	Security       int                           // DNSSEC status of ResourceRecord, one of SEC_*
+	Rank           int                           // lowest credibility of ResourceRecord, one of RANK_*
+	Proof          []packet.ResourceRecordFormat // NSEC(3) and RRSIG records of a negative or wildcard answer
 }
 
-// citem stores a cache item
-type citem struct {
-	data     []byte
+// DNSSEC status of cached data (RFC 4035 4.3)
+const (
+	SEC_UNCHECKED = iota // not validated (yet)
+	SEC_SECURE
+	SEC_INSECURE
+	SEC_BOGUS
+)
+
+// Credibility of cached data (RFC 2181 5.4.1), higher ranks win
+const (
+	RANK_ADDITIONAL     = iota + 1 // additional section, not referenced by the reply
+	RANK_GLUE                      // addresses of nameservers named in the reply
+	RANK_AUTHORITY                 // authority section of a non-authoritative reply
+	RANK_ANSWER                    // answer section of a non-authoritative reply
+	RANK_AUTH_AUTHORITY            // authority section of an authoritative reply
+	RANK_AUTH_ANSWER               // answer section of an authoritative reply
+)
+
+// crrset stores a cached RRset. All records share a single TTL,
+// the lowest one they were received with (RFC 2181 5.2)
+type crrset struct {
+	data     [][]byte // RDATA of all records
 	deadline time.Time
 	rcode    uint8
+	rank     int // credibility, one of RANK_*
+	security int
+	proof    []packet.ResourceRecordFormat
 }
 
-// centry is a cache entry.
-type centry map[string]citem
-
-// cmap maps keys t centries.
-type cmap map[uint16]centry
+// cmap maps the set keys of a name to its RRsets, see setKey()
+type cmap map[uint32]*crrset
 
 type Cache struct {
-	sync.RWMutex
-	CacheMap     map[string]cmap
-	MissMap      map[string]cmap
+	shards       []*cshard
+	staleWindow  time.Duration // how long expired sets are kept, see SetStaleWindow()
 	PutCallback  func(InjectSource)
-	VrfyCallback func(packet.QuestionFormat, *net.UDPAddr) *packet.Namelabel
+	VrfyCallback func(packet.QuestionFormat, *net.UDPAddr) *ReplyOrigin
+}
+
+// ReplyOrigin describes the query a reply was sent for
+type ReplyOrigin struct {
+	Zone      *packet.Namelabel // the zone the server was asked about, nothing outside of it is cached
+	Forwarder bool              // `true' if the server is a configured forwarder: its non-authoritative answers are trusted
 }
 
 type InjectSource struct {
@@ -44,9 +70,16 @@ type InjectSource struct {
 
 // NewNameCache returns a newly initialized cache reference
 func NewNameCache() *Cache {
-	c := &Cache{}
-	c.CacheMap = make(map[string]cmap, 0)
-	c.MissMap = make(map[string]cmap, 0)
+	return NewShardedCache(constants.CACHE_SHARDS)
+}
+
+// NewShardedCache returns a cache split into n independently locked shards
+func NewShardedCache(n int) *Cache {
+	c := &Cache{shards: make([]*cshard, n)}
+	for i := range c.shards {
+		c.shards[i] = newShard()
+	}
+	c.SetLimits(constants.CACHE_MAX_BYTES, constants.CACHE_MAX_ENTRIES, EVICT_LRU)
 	return c
 }
 
@@ -56,7 +89,7 @@ func (c *Cache) RegisterPutCallback(cb func(InjectSource)) {
 }
 
 // Registers a reply verify callback
-func (c *Cache) RegisterVeritfyCallback(cb func(packet.QuestionFormat, *net.UDPAddr) *packet.Namelabel) {
+func (c *Cache) RegisterVeritfyCallback(cb func(packet.QuestionFormat, *net.UDPAddr) *ReplyOrigin) {
 	c.VrfyCallback = cb
 }
 
@@ -68,43 +101,113 @@ func (c *Cache) Put(p *packet.ParsedPacket, ns *net.UDPAddr) {
 
 	// Check if we have a CrossHierarchy (XH) label
 	// a nil value indicates that this reply is invalid
-	xhlabel := c.VrfyCallback(p.Questions[0], ns)
-	if xhlabel == nil {
+	origin := c.VrfyCallback(p.Questions[0], ns)
+	if origin == nil {
 		l.Info("Dropping unexpected reply from %v", ns)
 		return
 	}
+	xhlabel := origin.Zone
 
 	qname := p.Questions[0].Name
 	qtype := p.Questions[0].Type
 	isrc := InjectSource{Name: qname, Type: qtype}
 
+	// Keep records proving the non-existence for negative entries, and
+	// that no closer match exists for answers expanded from a wildcard
+	proof := make([]packet.ResourceRecordFormat, 0)
+	for _, n := range p.Nameservers {
+		if n.Class == constants.CLASS_IN && n.Name.IsChildOf(xhlabel) {
+			switch n.Type {
+			case constants.TYPE_NSEC, constants.TYPE_NSEC3, constants.TYPE_RRSIG:
+				proof = append(proof, n)
+			}
+		}
+	}
+
+	answerRank, authorityRank := RANK_ANSWER, RANK_AUTHORITY
 	if p.Header.Authoritative == true {
-		for _, n := range p.Answers {
-			if n.Class == constants.CLASS_IN && n.Name.IsChildOf(xhlabel) {
-				c.injectPositiveItem(isrc, n)
+		answerRank, authorityRank = RANK_AUTH_ANSWER, RANK_AUTH_AUTHORITY
+	}
+	if p.Header.Authoritative == true || origin.Forwarder == true {
+		for _, rrset := range splitRRsets(answerChain(p, xhlabel)) {
+			c.injectPositiveSet(isrc, rrset, proof, answerRank)
+		}
+	}
+
+	// Addresses of nameservers named in this reply are glue,
+	// everything else in the additional section is less credible
+	glue := make(map[string]bool)
+	for _, n := range append(p.Answers, p.Nameservers...) {
+		if n.Type == constants.TYPE_NS {
+			if target, err := packet.ParseName(n.Data); err == nil {
+				glue[target.ToKey()] = true
 			}
 		}
 	}
 
 	// Scan if there any additional A or AAA records
+	addresses := make([]packet.ResourceRecordFormat, 0)
 	for _, n := range p.Additionals {
 		if n.Class == constants.CLASS_IN && n.Name.IsChildOf(xhlabel) {
 			if n.Type == constants.TYPE_A || n.Type == constants.TYPE_AAAA {
-				c.injectPositiveItem(isrc, n)
+				addresses = append(addresses, n)
 			}
 		}
 	}
+	for _, rrset := range splitRRsets(addresses) {
+		rank := RANK_ADDITIONAL
+		if glue[rrset[0].Name.ToKey()] {
+			rank = RANK_GLUE
+		}
+		c.injectPositiveSet(isrc, rrset, nil, rank)
+	}
 
+	// NS and SOA records must be owned by a zone enclosing the question
+	nameservers := make([]packet.ResourceRecordFormat, 0)
 	for _, n := range p.Nameservers {
-		if n.Class == constants.CLASS_IN && n.Name.IsChildOf(xhlabel) {
+		if n.Class == constants.CLASS_IN && n.Name.IsChildOf(xhlabel) && qname.IsChildOf(&n.Name) {
 			if n.Type == constants.TYPE_NS {
-				c.injectPositiveItem(isrc, n)
+				nameservers = append(nameservers, n)
 			}
 			if p.Header.AnswerCount == 0 && n.Type == constants.TYPE_SOA {
-				c.injectNegativeItem(isrc, n, p.Header.ResponseCode)
+				c.injectNegativeItem(isrc, n, p.Header.ResponseCode, proof, authorityRank)
+			}
+		}
+	}
+	for _, rrset := range splitRRsets(nameservers) {
+		c.injectPositiveSet(isrc, rrset, nil, authorityRank)
+	}
+}
+
+// answerChain returns all answers of p which belong to the question or the
+// chain of CNAMEs starting at it. The chain is not followed outside of zone.
+func answerChain(p *packet.ParsedPacket, zone *packet.Namelabel) []packet.ResourceRecordFormat {
+	result := make([]packet.ResourceRecordFormat, 0)
+	seen := make(map[string]bool)
+
+	name := p.Questions[0].Name
+	for name.IsChildOf(zone) && seen[name.ToKey()] == false {
+		key := name.ToKey()
+		seen[key] = true
+
+		var next *packet.Namelabel
+		for _, rr := range p.Answers {
+			if rr.Class != constants.CLASS_IN || rr.Name.ToKey() != key {
+				continue
+			}
+			result = append(result, rr)
+			if rr.Type == constants.TYPE_CNAME && next == nil {
+				if target, err := packet.ParseName(rr.Data); err == nil {
+					next = &target
+				}
 			}
 		}
+		if next == nil {
+			break
+		}
+		name = *next
 	}
+	return result
 }
 
 // Lookup returns the CacheResult of given Namelabel and Type combination
@@ -112,77 +215,101 @@ func (c *Cache) Put(p *packet.ParsedPacket, ns *net.UDPAddr) {
 // re will be nil if there was no negative match
 // rr == re == nil if the entry is completely unknown
 func (c *Cache) Lookup(label packet.Namelabel, t uint16) (rr *CacheResult, re *CacheResult) {
+	return c.lookup(label, t, false)
+}
+
+// lookup implements Lookup and LookupStale, which
+// also returns sets expired less than staleWindow ago
+func (c *Cache) lookup(label packet.Namelabel, t uint16, stale bool) (rr *CacheResult, re *CacheResult) {
 	key := label.ToKey()
 	now := time.Now()
 
-	c.Lock()
-	defer c.Unlock()
+	s := c.shard(key)
+	s.RLock()
+	defer s.RUnlock()
 
-	if c.CacheMap[key] != nil {
-		qtypes := []uint16{t}                         // the types we are going to query from the cache
+	if s.cache[key] != nil {
 		ent := make([]packet.ResourceRecordFormat, 0) // the final response
-
-		if t == constants.QTYPE_ALL && len(c.CacheMap[key]) > 0 {
-			// special case: This was an ANY query and we DO have some data.
-			// As QTYPE_ALL is not a valid type, we are just going to return all rr's we got data for
-			qtypes = []uint16{}
-			for k, _ := range c.CacheMap[key] {
-				qtypes = append(qtypes, k)
+		security := -1                                // shared status of all returned items
+		rank := 0                                     // lowest rank of all returned items
+		var proof []packet.ResourceRecordFormat       // NSEC(3) records of wildcard answers
+
+		for _, k := range lookupKeys(s.cache[key], t) {
+			rrset := s.cache[key][k]
+			if rrset == nil {
+				continue
 			}
-		}
-
-		for _, qtype := range qtypes {
-			if c.CacheMap[key][qtype] != nil {
-				for _, item := range c.CacheMap[key][qtype] {
-					if now.Before(item.deadline) {
-						ttl := uint32(item.deadline.Sub(now).Seconds())
-						ent = append(ent, packet.ResourceRecordFormat{Name: label, Class: constants.CLASS_IN, Type: qtype, Ttl: ttl, Data: item.data})
-					}
-				}
+			ttl, ok := c.remaining(rrset, now, stale)
+			if !ok {
+				continue
 			}
+			s.touch(false, key, k)
+			for _, data := range rrset.data {
+				ent = append(ent, packet.ResourceRecordFormat{Name: label, Class: constants.CLASS_IN, Type: uint16(k), Ttl: ttl, Data: data})
+			}
+			if security == -1 {
+				security = rrset.security
+			} else if security != rrset.security {
+				security = SEC_UNCHECKED
+			}
+			if rank == 0 || rrset.rank < rank {
+				rank = rrset.rank
+			}
+			proof = append(proof, rrset.proof...)
 		}
 
 		if len(ent) > 0 { // ensure to return a null pointer if ent is empty
-			rr = &CacheResult{ResourceRecord: ent, ResponseCode: constants.RC_NO_ERR}
+			rr = &CacheResult{ResourceRecord: ent, ResponseCode: constants.RC_NO_ERR, Security: security, Rank: rank, Proof: proof}
 		}
 	}
 
 	// rr will be nil on cache miss, check if we have a negative cache entry
-	if rr == nil && c.MissMap[key] != nil {
+	if rr == nil && s.miss[key] != nil {
 		mtype := t
-		if c.MissMap[key][constants.TYPE_SOA] != nil {
+		if s.miss[key][constants.TYPE_SOA] != nil {
 			// we do have a negative soa entry, so the domain simply does not exist
 			// and there is no point in looking up 't'
 			mtype = constants.TYPE_SOA
 		}
-		if c.MissMap[key][mtype] != nil {
-			for _, item := range c.MissMap[key][mtype] {
-				if now.Before(item.deadline) {
-					ttl := uint32(item.deadline.Sub(now).Seconds())
-					// unparse fiddled-in soa label
-					rend := item.data[0] + 1
-					rlabel := item.data[1:rend]
-					plabel, _ := packet.ParseName(rlabel)
-					ent := make([]packet.ResourceRecordFormat, 0)
-					ent = append(ent, packet.ResourceRecordFormat{Name: plabel, Class: constants.CLASS_IN, Type: constants.TYPE_SOA, Ttl: ttl, Data: item.data[rend:]})
-					re = &CacheResult{ResourceRecord: ent, ResponseCode: item.rcode}
-				}
+		if item := s.miss[key][uint32(mtype)]; item != nil {
+			if ttl, ok := c.remaining(item, now, stale); ok {
+				s.touch(true, key, uint32(mtype))
+				re = negativeResult(item, ttl)
 			}
 		}
 	}
 	return
 }
 
-func (c *Cache) dump() {
+// negativeResult converts a negative entry into its CacheResult
+func negativeResult(item *crrset, ttl uint32) *CacheResult {
+	// unparse fiddled-in soa label
+	data := item.data[0]
+	rend := data[0] + 1
+	rlabel := data[1:rend]
+	plabel, _ := packet.ParseName(rlabel)
+	ent := make([]packet.ResourceRecordFormat, 0)
+	ent = append(ent, packet.ResourceRecordFormat{Name: plabel, Class: constants.CLASS_IN, Type: constants.TYPE_SOA, Ttl: ttl, Data: data[rend:]})
+	return &CacheResult{ResourceRecord: ent, ResponseCode: item.rcode, Rank: item.rank, Proof: item.proof}
+}
 
-	for name, tmap := range c.CacheMap {
-		for t, centry := range tmap {
-			for plx, _ := range centry {
-				fmt.Printf("%-21s [%2d] = %+v\n", name, t, plx)
-			}
+// SetSecurity sets the DNSSEC status of all positive
+// entries of given Namelabel and Type combination.
+// Bogus data expires after CACHE_BOGUS_TTL (RFC 4035 4.7).
+func (c *Cache) SetSecurity(label packet.Namelabel, t uint16, security int) {
+	key := label.ToKey()
+
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if rrset := s.cache[key][uint32(t)]; rrset != nil {
+		rrset.security = security
+		limit := time.Now().Add(constants.CACHE_BOGUS_TTL)
+		if security == SEC_BOGUS && rrset.deadline.After(limit) {
+			rrset.deadline = limit
 		}
 	}
-
 }
 
 func (c *Cache) notify(isrc InjectSource) {
@@ -193,7 +320,7 @@ func (c *Cache) notify(isrc InjectSource) {
 
 // injectNegativeItem marks given label as non existing. rc defines the return code
 // item is supposed to be a SOA
-func (c *Cache) injectNegativeItem(isrc InjectSource, item packet.ResourceRecordFormat, rcode uint8) {
+func (c *Cache) injectNegativeItem(isrc InjectSource, item packet.ResourceRecordFormat, rcode uint8, proof []packet.ResourceRecordFormat, rank int) {
 	if item.Type != constants.TYPE_SOA {
 		panic("Not a SOA!")
 	}
@@ -228,35 +355,74 @@ func (c *Cache) injectNegativeItem(isrc InjectSource, item packet.ResourceRecord
 		item.Type = constants.TYPE_SOA
 	}
 
-	c.injectInternal(c.MissMap, isrc, item, rcode)
+	c.injectInternal(true, isrc, []packet.ResourceRecordFormat{item}, rcode, proof, rank)
 }
 
-// inject puts given resource record format item into our positive cache
-func (c *Cache) injectPositiveItem(isrc InjectSource, item packet.ResourceRecordFormat) {
-	c.injectInternal(c.CacheMap, isrc, item, 0)
+// injectPositiveSet puts the RRset rrset into our positive cache.
+// proof holds the NSEC(3) records sent along with a wildcard answer.
+func (c *Cache) injectPositiveSet(isrc InjectSource, rrset []packet.ResourceRecordFormat, proof []packet.ResourceRecordFormat, rank int) {
+	c.injectInternal(false, isrc, rrset, 0, proof, rank)
 }
 
-// Internal implementation of cache who works on multiple maps
-func (c *Cache) injectInternal(m map[string]cmap, isrc InjectSource, item packet.ResourceRecordFormat, rcode uint8) {
-	key := item.Name.ToKey()
-	t := item.Type
-	data := item.Data
-	ttl := item.Ttl
+// Internal implementation of cache who works on the positive and negative (miss) map
+// of the shard owning rrset. The callback is notified after the shard was unlocked,
+// so it may look up the cache again.
+func (c *Cache) injectInternal(miss bool, isrc InjectSource, rrset []packet.ResourceRecordFormat, rcode uint8, proof []packet.ResourceRecordFormat, rank int) {
+	c.shard(rrset[0].Name.ToKey()).inject(miss, rrset, rcode, proof, rank)
+	c.notify(isrc)
+}
 
-	c.Lock()
-	defer c.Unlock()
+// setKey returns the key of the RRset a record with type t and given RDATA belongs to.
+// RRSIGs covering different types do not form a single RRset and may have different
+// TTLs (RFC 4034 3), so they are stored per covered type.
+func setKey(t uint16, data []byte) uint32 {
+	if t == constants.TYPE_RRSIG && len(data) >= 2 {
+		return uint32(t) | uint32(data[0])<<24 | uint32(data[1])<<16
+	}
+	return uint32(t)
+}
 
-	if m[key] == nil {
-		m[key] = make(cmap, 0)
+// lookupKeys returns the keys of all sets in m answering a query for type t
+func lookupKeys(m cmap, t uint16) []uint32 {
+	if t != constants.QTYPE_ALL && t != constants.TYPE_RRSIG {
+		return []uint32{uint32(t)}
 	}
-	if m[key][t] == nil {
-		m[key][t] = make(centry, 0)
+	keys := make([]uint32, 0, len(m))
+	for k := range m {
+		if t == constants.QTYPE_ALL || uint16(k) == t {
+			keys = append(keys, k)
+		}
 	}
+	return keys
+}
 
-	l.Debug("+ cache inject: %+v", item)
+// splitRRsets groups rrs by owner name and set key, keeping their order
+func splitRRsets(rrs []packet.ResourceRecordFormat) [][]packet.ResourceRecordFormat {
+	index := make(map[string]int)
+	result := make([][]packet.ResourceRecordFormat, 0)
+	for _, rr := range rrs {
+		k := fmt.Sprintf("%s/%d", rr.Name.ToKey(), setKey(rr.Type, rr.Data))
+		if i, ok := index[k]; ok {
+			result[i] = append(result[i], rr)
+		} else {
+			index[k] = len(result)
+			result = append(result, []packet.ResourceRecordFormat{rr})
+		}
+	}
+	return result
+}
 
-	cpy := make([]byte, len(data))
-	copy(cpy, data)
-	m[key][t][string(data)] = citem{data: cpy, deadline: time.Now().Add(time.Duration(ttl) * time.Second), rcode: rcode}
-	c.notify(isrc)
+// copyRecords returns a deep copy of rrs, as the raw data of
+// parsed records may still point into a (reused) read buffer
+func copyRecords(rrs []packet.ResourceRecordFormat) []packet.ResourceRecordFormat {
+	if len(rrs) == 0 {
+		return nil
+	}
+	result := make([]packet.ResourceRecordFormat, len(rrs))
+	for i, rr := range rrs {
+		result[i] = rr
+		result[i].Data = make([]byte, len(rr.Data))
+		copy(result[i].Data, rr.Data)
+	}
+	return result
 }
@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func rankTestCache() *Cache {
+	c := NewNameCache()
+	root, _ := packet.ParseTextName(".")
+	c.RegisterVeritfyCallback(func(packet.QuestionFormat, *net.UDPAddr) *ReplyOrigin { return &ReplyOrigin{Zone: &root} })
+	return c
+}
+
+func rankTestAddress(c *Cache, name packet.Namelabel) string {
+	rr, _ := c.Lookup(name, constants.TYPE_A)
+	if rr == nil || len(rr.ResourceRecord) != 1 {
+		panic(fmt.Errorf("Expected a single A record for %v, got %+v", name, rr))
+	}
+	return net.IP(rr.ResourceRecord[0].Data).String()
+}
+
+func TestRankedReplacement(t *testing.T) {
+	c := rankTestCache()
+	zone, _ := packet.ParseTextName("example.com")
+	ns, _ := packet.ParseTextName("ns.example.com")
+	q := packet.QuestionFormat{Name: ns, Type: constants.TYPE_A, Class: constants.CLASS_IN}
+
+	// a referral: NS in authority with glue
+	referral := &packet.ParsedPacket{Questions: []packet.QuestionFormat{q}}
+	referral.Nameservers = append(referral.Nameservers, packet.ResourceRecordFormat{Name: zone, Type: constants.TYPE_NS, Class: constants.CLASS_IN, Ttl: 60, Data: packet.EncodeName(ns)})
+	referral.Additionals = append(referral.Additionals, packet.ResourceRecordFormat{Name: ns, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 1}})
+	c.Put(referral, nil)
+	if rankTestAddress(c, ns) != "192.0.2.1" {
+		panic(fmt.Errorf("Glue was not cached"))
+	}
+	if rr, _ := c.Lookup(ns, constants.TYPE_A); rr.Rank != RANK_GLUE {
+		panic(fmt.Errorf("Expected glue to have rank %d, got %d", RANK_GLUE, rr.Rank))
+	}
+
+	// the authoritative answer replaces the glue
+	answer := &packet.ParsedPacket{Questions: []packet.QuestionFormat{q}}
+	answer.Header.Authoritative = true
+	answer.Answers = append(answer.Answers, packet.ResourceRecordFormat{Name: ns, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 2}})
+	c.Put(answer, nil)
+	if rankTestAddress(c, ns) != "192.0.2.2" {
+		panic(fmt.Errorf("Authoritative answer did not replace the glue"))
+	}
+	if rr, _ := c.Lookup(ns, constants.TYPE_A); rr.Rank != RANK_AUTH_ANSWER {
+		panic(fmt.Errorf("Expected the answer to have rank %d, got %d", RANK_AUTH_ANSWER, rr.Rank))
+	}
+
+	// an unrelated additional record must not override it
+	other := &packet.ParsedPacket{Questions: []packet.QuestionFormat{{Name: zone, Type: constants.TYPE_MX, Class: constants.CLASS_IN}}}
+	other.Additionals = append(other.Additionals, packet.ResourceRecordFormat{Name: ns, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 3}})
+	c.Put(other, nil)
+	if rankTestAddress(c, ns) != "192.0.2.2" {
+		panic(fmt.Errorf("Additional data replaced an authoritative answer"))
+	}
+}
+
+func TestOutOfZoneAuthority(t *testing.T) {
+	c := rankTestCache()
+	name, _ := packet.ParseTextName("www.example.com")
+	other, _ := packet.ParseTextName("example.net")
+
+	// NS records not enclosing the question must be ignored
+	p := &packet.ParsedPacket{Questions: []packet.QuestionFormat{{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN}}}
+	p.Nameservers = append(p.Nameservers, packet.ResourceRecordFormat{Name: other, Type: constants.TYPE_NS, Class: constants.CLASS_IN, Ttl: 60, Data: packet.EncodeName(name)})
+	c.Put(p, nil)
+	if rr, _ := c.Lookup(other, constants.TYPE_NS); rr != nil {
+		panic(fmt.Errorf("Cached unrelated NS records: %+v", rr))
+	}
+}
+
+func TestAnswerChain(t *testing.T) {
+	c := rankTestCache()
+	zone, _ := packet.ParseTextName("example.com")
+	c.RegisterVeritfyCallback(func(packet.QuestionFormat, *net.UDPAddr) *ReplyOrigin { return &ReplyOrigin{Zone: &zone} })
+
+	www, _ := packet.ParseTextName("www.example.com")
+	alias, _ := packet.ParseTextName("alias.example.com")
+	outside, _ := packet.ParseTextName("cdn.example.net")
+	unrelated, _ := packet.ParseTextName("mail.example.com")
+
+	p := &packet.ParsedPacket{Questions: []packet.QuestionFormat{{Name: www, Type: constants.TYPE_A, Class: constants.CLASS_IN}}}
+	p.Header.Authoritative = true
+	p.Answers = append(p.Answers, packet.ResourceRecordFormat{Name: www, Type: constants.TYPE_CNAME, Class: constants.CLASS_IN, Ttl: 60, Data: packet.EncodeName(alias)})
+	p.Answers = append(p.Answers, packet.ResourceRecordFormat{Name: alias, Type: constants.TYPE_CNAME, Class: constants.CLASS_IN, Ttl: 60, Data: packet.EncodeName(outside)})
+	p.Answers = append(p.Answers, packet.ResourceRecordFormat{Name: outside, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 1}})
+	p.Answers = append(p.Answers, packet.ResourceRecordFormat{Name: unrelated, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 2}})
+	c.Put(p, nil)
+
+	if rr, _ := c.Lookup(alias, constants.TYPE_CNAME); rr == nil {
+		panic(fmt.Errorf("CNAME chain was not cached"))
+	}
+	if rr, _ := c.Lookup(outside, constants.TYPE_A); rr != nil {
+		panic(fmt.Errorf("Cached the out of zone target of the chain"))
+	}
+	if rr, _ := c.Lookup(unrelated, constants.TYPE_A); rr != nil {
+		panic(fmt.Errorf("Cached an answer which is not part of the chain"))
+	}
+}
+
+func TestForwarderAnswers(t *testing.T) {
+	c := rankTestCache()
+	name, _ := packet.ParseTextName("www.example.com")
+	p := &packet.ParsedPacket{Questions: []packet.QuestionFormat{{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN}}}
+	p.Answers = append(p.Answers, packet.ResourceRecordFormat{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 1}})
+
+	c.Put(p, nil)
+	if rr, _ := c.Lookup(name, constants.TYPE_A); rr != nil {
+		panic(fmt.Errorf("Cached a non-authoritative answer"))
+	}
+
+	root, _ := packet.ParseTextName(".")
+	c.RegisterVeritfyCallback(func(packet.QuestionFormat, *net.UDPAddr) *ReplyOrigin {
+		return &ReplyOrigin{Zone: &root, Forwarder: true}
+	})
+	c.Put(p, nil)
+	if rankTestAddress(c, name) != "192.0.2.1" {
+		panic(fmt.Errorf("Forwarded answer was not cached"))
+	}
+}
+
+func TestRRsetTtl(t *testing.T) {
+	c := rankTestCache()
+	name, _ := packet.ParseTextName("www.example.com")
+	q := packet.QuestionFormat{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN}
+
+	// members of an RRset share the lowest TTL (RFC 2181 5.2)
+	p := &packet.ParsedPacket{Questions: []packet.QuestionFormat{q}}
+	p.Header.Authoritative = true
+	p.Answers = append(p.Answers, packet.ResourceRecordFormat{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 3600, Data: []byte{192, 0, 2, 1}})
+	p.Answers = append(p.Answers, packet.ResourceRecordFormat{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 2}})
+	c.Put(p, nil)
+	rr, _ := c.Lookup(name, constants.TYPE_A)
+	if rr == nil || len(rr.ResourceRecord) != 2 {
+		panic(fmt.Errorf("Expected two A records, got %+v", rr))
+	}
+	for _, r := range rr.ResourceRecord {
+		if r.Ttl > 60 {
+			panic(fmt.Errorf("Record kept its own TTL: %+v", r))
+		}
+	}
+
+	// a fresh RRset replaces the cached one as a whole
+	p = &packet.ParsedPacket{Questions: []packet.QuestionFormat{q}}
+	p.Header.Authoritative = true
+	p.Answers = append(p.Answers, packet.ResourceRecordFormat{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 300, Data: []byte{192, 0, 2, 3}})
+	c.Put(p, nil)
+	if rankTestAddress(c, name) != "192.0.2.3" {
+		panic(fmt.Errorf("RRset was merged instead of replaced"))
+	}
+}
+
+func TestBogusTtl(t *testing.T) {
+	c := NewNameCache()
+	evictTestPut(c, "bogus.example", 3600)
+	name, _ := packet.ParseTextName("bogus.example")
+
+	// RFC 4035 4.7: bogus data is remembered, but only for a short time
+	c.SetSecurity(name, constants.TYPE_A, SEC_BOGUS)
+	rr, _ := c.Lookup(name, constants.TYPE_A)
+	if rr == nil || rr.Security != SEC_BOGUS || rr.ResourceRecord[0].Ttl > uint32(constants.CACHE_BOGUS_TTL.Seconds()) {
+		panic(fmt.Errorf("Expected bogus data with a capped TTL, got %+v", rr))
+	}
+}
+
+func TestWildcardProof(t *testing.T) {
+	c := rankTestCache()
+	name, _ := packet.ParseTextName("foo.example.com")
+	owner, _ := packet.ParseTextName("a.example.com")
+	next, _ := packet.ParseTextName("z.example.com")
+	q := packet.QuestionFormat{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN}
+
+	// the NSEC in authority proves that no closer match than the wildcard exists
+	answer := &packet.ParsedPacket{Questions: []packet.QuestionFormat{q}}
+	answer.Header.Authoritative = true
+	answer.Answers = append(answer.Answers, packet.ResourceRecordFormat{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 1}})
+	answer.Nameservers = append(answer.Nameservers, packet.ResourceRecordFormat{Name: owner, Type: constants.TYPE_NSEC, Class: constants.CLASS_IN, Ttl: 60, Data: append(packet.EncodeName(next), 0, 1, 0x40)})
+	c.Put(answer, nil)
+
+	rr, _ := c.Lookup(name, constants.TYPE_A)
+	if rr == nil || len(rr.Proof) != 1 || rr.Proof[0].Type != constants.TYPE_NSEC {
+		panic(fmt.Errorf("Expected the answer to carry the NSEC proof, got %+v", rr))
+	}
+}
+
+func evictTestPut(c *Cache, name string, ttl uint32) {
+	n, _ := packet.ParseTextName(name)
+	rr := packet.ResourceRecordFormat{Name: n, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: ttl, Data: []byte{192, 0, 2, 1}}
+	c.injectPositiveSet(InjectSource{Name: n, Type: constants.TYPE_A}, []packet.ResourceRecordFormat{rr}, nil, RANK_ANSWER)
+}
+
+func evictTestCached(c *Cache, name string) bool {
+	n, _ := packet.ParseTextName(name)
+	rr, _ := c.Lookup(n, constants.TYPE_A)
+	return rr != nil
+}
+
+func TestEviction(t *testing.T) {
+	for _, policy := range []int{EVICT_LRU, EVICT_LFU} {
+		c := NewShardedCache(1) // limits are per shard
+		c.SetLimits(0, 2, policy)
+		evictTestPut(c, "a.example", 60)
+		evictTestPut(c, "b.example", 60)
+		evictTestCached(c, "a.example")
+		evictTestCached(c, "b.example")
+		evictTestCached(c, "a.example") // a is now the most recently and frequently used set
+
+		evictTestPut(c, "c.example", 60)
+		if !evictTestCached(c, "a.example") || evictTestCached(c, "b.example") || !evictTestCached(c, "c.example") {
+			panic(fmt.Errorf("Policy %d evicted the wrong entry", policy))
+		}
+		if st := c.Stats(); st.Entries != 2 || st.Evicted != 1 {
+			panic(fmt.Errorf("Unexpected stats: %+v", st))
+		}
+	}
+
+	c := NewShardedCache(1)
+	evictTestPut(c, "a0.example", 60)
+	size := c.Stats().Bytes
+	c.SetLimits(size*3, 0, EVICT_LRU)
+	for i := 0; i < 10; i++ {
+		evictTestPut(c, fmt.Sprintf("x%d.example", i), 60)
+	}
+	if st := c.Stats(); st.Bytes > size*3 || st.Entries != 3 {
+		panic(fmt.Errorf("Byte limit was not enforced: %+v", st))
+	}
+}
+
+func TestSweep(t *testing.T) {
+	c := NewNameCache()
+	evictTestPut(c, "short.example", 1)
+	evictTestPut(c, "long.example", 3600)
+
+	if n := c.Sweep(time.Now().Add(2 * time.Second)); n != 1 {
+		panic(fmt.Errorf("Expected 1 expired RRset, got %d", n))
+	}
+	if _, ok := c.shard("SHORT/EXAMPLE/;").cache["SHORT/EXAMPLE/;"]; ok {
+		panic(fmt.Errorf("Expired entry is still in the map"))
+	}
+	if st := c.Stats(); st.Entries != 1 || st.Expired != 1 || !evictTestCached(c, "long.example") {
+		panic(fmt.Errorf("Unexpected stats: %+v", st))
+	}
+}
+
+// benchmarkCache runs lookups of cached names from all CPUs (see -cpu),
+// every writeEvery'th operation takes the write lock of a shard instead
+func benchmarkCache(b *testing.B, shards int, writeEvery int) {
+	c := NewShardedCache(shards)
+	names := make([]packet.Namelabel, 4096)
+	for i := range names {
+		names[i], _ = packet.ParseTextName(fmt.Sprintf("host%d.example", i))
+		// fill the shards directly, inject() would log every record
+		key := names[i].ToKey()
+		s := c.shard(key)
+		s.cache[key] = cmap{constants.TYPE_A: &crrset{data: [][]byte{{192, 0, 2, 1}}, deadline: time.Now().Add(time.Hour)}}
+		s.account(false, key, constants.TYPE_A)
+	}
+
+	var seed uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&seed, 1)) * 7919
+		for pb.Next() {
+			i++
+			name := names[i%len(names)]
+			if writeEvery > 0 && i%writeEvery == 0 {
+				c.SetSecurity(name, constants.TYPE_A, SEC_INSECURE)
+			} else if rr, _ := c.Lookup(name, constants.TYPE_A); rr == nil {
+				panic(fmt.Errorf("%v is not cached", &name))
+			}
+		}
+	})
+}
+
+func BenchmarkLookup(b *testing.B) {
+	for _, shards := range []int{1, constants.CACHE_SHARDS} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) { benchmarkCache(b, shards, 0) })
+	}
+}
+
+func BenchmarkLookupWithWrites(b *testing.B) {
+	for _, shards := range []int{1, constants.CACHE_SHARDS} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) { benchmarkCache(b, shards, 10) })
+	}
+}
@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"fmt"
+	l "github.com/adrian-bl/rna/lib/log"
+	"sync/atomic"
+	"time"
+)
+
+// Policies deciding which RRset is dropped if the cache is full
+const (
+	EVICT_LRU = iota // the least recently used one
+	EVICT_LFU        // the least frequently used one, aged to drop formerly popular sets (LFU-DA)
+)
+
+const (
+	ITEM_OVERHEAD = 64  // approx. bytes used by a cached record besides its data
+	SET_OVERHEAD  = 192 // approx. bytes used by an RRset besides its records and name
+	EVICT_SAMPLES = 8   // number of random sets compared to pick the one to evict
+)
+
+// Statistics about the cache
+type CacheStats struct {
+	Entries int    // number of cached RRsets, positive and negative
+	Bytes   int    // approx. memory used by the cached data
+	Evicted uint64 // RRsets dropped to stay within the limits
+	Expired uint64 // RRsets removed by the sweeper
+}
+
+// cset tracks the size and usage of a cached RRset
+type cset struct {
+	miss bool   // `true' if the set belongs to the negative cache
+	key  string // cache key of the owner name
+	t    uint32 // set key, see setKey()
+	size int    // accounted bytes
+	hits uint64 // number of lookups returning this set, plus the shard age at insertion. Accessed atomically.
+	used uint64 // tick of the last access, accessed atomically
+}
+
+// csetKey identifies a cset
+type csetKey struct {
+	miss bool
+	key  string
+	t    uint32
+}
+
+// SetLimits bounds the cache to maxBytes of (approx.) memory and maxEntries RRsets,
+// a value of 0 disables the respective limit. policy is one of EVICT_*.
+// The limits are split evenly across all shards.
+func (c *Cache) SetLimits(maxBytes int, maxEntries int, policy int) {
+	n := len(c.shards)
+	for _, s := range c.shards {
+		s.Lock()
+		s.maxBytes = (maxBytes + n - 1) / n
+		s.maxEntries = (maxEntries + n - 1) / n
+		s.policy = policy
+		s.enforceLimits(nil)
+		s.Unlock()
+	}
+}
+
+// Stats returns statistics about the cache
+func (c *Cache) Stats() CacheStats {
+	st := CacheStats{}
+	for _, s := range c.shards {
+		s.RLock()
+		st.Entries += len(s.sets)
+		st.Bytes += s.bytes
+		st.Evicted += s.evicted
+		st.Expired += s.expired
+		s.RUnlock()
+	}
+	return st
+}
+
+// StartSweeper purges expired records every interval
+func (c *Cache) StartSweeper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if n := c.Sweep(time.Now()); n > 0 {
+				st := c.Stats()
+				l.Debug("cache sweeper removed %d expired RRsets, %d sets using %d bytes remain", n, st.Entries, st.Bytes)
+			}
+		}
+	}()
+}
+
+// Sweep removes all RRsets which expired at now, or which left the stale window, and
+// returns their number. Shards are locked one after another, so lookups of other
+// shards may proceed.
+func (c *Cache) Sweep(now time.Time) int {
+	removed := 0
+	for _, s := range c.shards {
+		s.Lock()
+		removed += s.sweep(now.Add(-c.staleWindow))
+		s.Unlock()
+	}
+	return removed
+}
+
+// sweep removes all expired RRsets of this shard. Must be called locked.
+func (s *cshard) sweep(now time.Time) int {
+	removed := 0
+	for _, set := range s.sets {
+		if rrset := s.setMap(set.miss)[set.key][set.t]; rrset == nil || now.After(rrset.deadline) {
+			s.removeSet(set)
+			removed++
+		}
+	}
+	s.expired += uint64(removed)
+	return removed
+}
+
+// account updates the size of the given RRset after it was modified,
+// dropping it if it became empty. Must be called locked.
+func (s *cshard) account(miss bool, key string, t uint32) {
+	ck := csetKey{miss: miss, key: key, t: t}
+	set := s.sets[ck]
+	rrset := s.setMap(miss)[key][t]
+
+	if rrset == nil {
+		if set != nil {
+			s.removeSet(set)
+		} else {
+			s.deleteEntry(miss, key, t)
+		}
+		return
+	}
+	if set == nil {
+		set = &cset{miss: miss, key: key, t: t, used: atomic.AddUint64(&s.tick, 1), hits: s.age}
+		s.sets[ck] = set
+	}
+
+	size := SET_OVERHEAD + len(key)
+	for _, data := range rrset.data {
+		size += ITEM_OVERHEAD + len(data)
+	}
+	for _, rr := range rrset.proof {
+		size += ITEM_OVERHEAD + len(rr.Data) + rr.Name.Len()*16
+	}
+	s.bytes += size - set.size
+	set.size = size
+}
+
+// touch marks the given RRset as used. Only needs the read lock.
+func (s *cshard) touch(miss bool, key string, t uint32) {
+	if set := s.sets[csetKey{miss: miss, key: key, t: t}]; set != nil {
+		atomic.StoreUint64(&set.used, atomic.AddUint64(&s.tick, 1))
+		atomic.AddUint64(&set.hits, 1)
+	}
+}
+
+// removeSet drops set and all of its records. Must be called locked.
+func (s *cshard) removeSet(set *cset) {
+	s.deleteEntry(set.miss, set.key, set.t)
+	delete(s.sets, csetKey{miss: set.miss, key: set.key, t: set.t})
+	s.bytes -= set.size
+}
+
+// deleteEntry removes the records of an RRset from the cache maps. Must be called locked.
+func (s *cshard) deleteEntry(miss bool, key string, t uint32) {
+	m := s.setMap(miss)
+	if m[key] != nil {
+		delete(m[key], t)
+		if len(m[key]) == 0 {
+			delete(m, key)
+		}
+	}
+}
+
+// enforceLimits evicts RRsets until the shard is within its limits,
+// never evicting keep (the set just inserted). Must be called locked.
+func (s *cshard) enforceLimits(keep *cset) {
+	for (s.maxBytes > 0 && s.bytes > s.maxBytes) || (s.maxEntries > 0 && len(s.sets) > s.maxEntries) {
+		victim := s.victim(keep)
+		if victim == nil {
+			return
+		}
+		l.Debug("+ cache full, evicting %s", victim)
+		if s.policy == EVICT_LFU {
+			s.age = atomic.LoadUint64(&victim.hits) // new sets start with the count of the last evicted one
+		}
+		s.removeSet(victim)
+		s.evicted++
+	}
+}
+
+// victim returns the set to evict next: the one the policy ranks lowest out
+// of a few sets, sampled using the random iteration order of maps. Sampling
+// keeps lookups cheap, as they do not need to maintain an ordered structure.
+// Must be called locked.
+func (s *cshard) victim(keep *cset) *cset {
+	var victim *cset
+	n := 0
+	for _, set := range s.sets {
+		if set == keep {
+			continue
+		}
+		if victim == nil || s.evictsBefore(set, victim) {
+			victim = set
+		}
+		if n++; n == EVICT_SAMPLES {
+			break
+		}
+	}
+	return victim
+}
+
+// evictsBefore returns true if a should be evicted before b
+func (s *cshard) evictsBefore(a *cset, b *cset) bool {
+	if s.policy == EVICT_LFU {
+		ah, bh := atomic.LoadUint64(&a.hits), atomic.LoadUint64(&b.hits)
+		if ah != bh {
+			return ah < bh
+		}
+	}
+	return atomic.LoadUint64(&a.used) < atomic.LoadUint64(&b.used)
+}
+
+func (set *cset) String() string {
+	return fmt.Sprintf("key=%s, type=%d, miss=%v, size=%d, hits=%d", set.key, set.t, set.miss, set.size, atomic.LoadUint64(&set.hits))
+}
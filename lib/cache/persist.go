@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"encoding/gob"
+	"fmt"
+	l "github.com/adrian-bl/rna/lib/log"
+	"github.com/adrian-bl/rna/lib/packet"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DUMP_MAGIC   = "rna-cache" // identifies a cache dump
+	DUMP_VERSION = 2           // bumped on incompatible changes of dumpSet
+)
+
+// dumpHeader starts each cache dump
+type dumpHeader struct {
+	Magic   string
+	Version int
+}
+
+// dumpSet is the serialized form of a cached RRset. The DNSSEC status is not
+// included: signatures may expire while rna is not running, so restored data
+// must be validated again.
+type dumpSet struct {
+	Miss     bool
+	Key      string // cache key of the owner name
+	SetKey   uint32
+	Data     [][]byte
+	Deadline time.Time // absolute, so sets expire while rna is not running
+	Rcode    uint8
+	Rank     int
+	Proof    []dumpRecord
+}
+
+// dumpRecord is the serialized form of a proof record
+type dumpRecord struct {
+	Name  []byte // in wire format
+	Type  uint16
+	Class uint16
+	Ttl   uint32
+	Data  []byte
+}
+
+// Save writes all positive and negative entries which did not expire yet to w
+// and returns the number of written RRsets. Shards are locked one after another,
+// so the dump is not an atomic snapshot of the whole cache.
+func (c *Cache) Save(w io.Writer) (int, error) {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(&dumpHeader{Magic: DUMP_MAGIC, Version: DUMP_VERSION}); err != nil {
+		return 0, err
+	}
+
+	saved := 0
+	now := time.Now()
+	for _, s := range c.shards {
+		for _, set := range s.snapshot(now) {
+			if err := enc.Encode(set); err != nil {
+				return saved, err
+			}
+			saved++
+		}
+	}
+	return saved, nil
+}
+
+// Restore adds all RRsets read from a dump written by Save which are still valid
+// at now. Entries already in the cache are only replaced by data of a higher rank
+// and damaged entries are skipped. The PutCallback is not called. Returns the
+// number of restored RRsets.
+func (c *Cache) Restore(r io.Reader, now time.Time) (int, error) {
+	dec := gob.NewDecoder(r)
+	hdr := dumpHeader{}
+	if err := dec.Decode(&hdr); err != nil {
+		return 0, err
+	}
+	if hdr.Magic != DUMP_MAGIC || hdr.Version != DUMP_VERSION {
+		return 0, fmt.Errorf("unsupported cache dump: %s version %d", hdr.Magic, hdr.Version)
+	}
+
+	restored := 0
+	for {
+		set := dumpSet{}
+		if err := dec.Decode(&set); err == io.EOF {
+			return restored, nil
+		} else if err != nil {
+			return restored, err
+		}
+		if !now.Before(set.Deadline) || len(set.Data) == 0 {
+			continue
+		}
+		rrset, err := set.rrset()
+		if err != nil {
+			l.Info("skipping damaged cache dump entry %s: %v", set.Key, err)
+			continue
+		}
+		if c.shard(set.Key).restore(set.Miss, set.Key, set.SetKey, rrset, now) {
+			restored++
+		}
+	}
+}
+
+// SaveFile writes a dump of the cache to path. The file is replaced atomically,
+// so a crash while saving does not destroy the previous dump.
+func (c *Cache) SaveFile(path string) (int, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) // no-op after a successful rename
+
+	n, err := c.Save(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
+
+// RestoreFile restores the dump stored in path, see Restore()
+func (c *Cache) RestoreFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return c.Restore(f, time.Now())
+}
+
+// snapshot returns all sets of this shard which are valid at now
+func (s *cshard) snapshot(now time.Time) []*dumpSet {
+	s.RLock()
+	defer s.RUnlock()
+
+	result := make([]*dumpSet, 0, len(s.sets))
+	for _, set := range s.sets {
+		rrset := s.setMap(set.miss)[set.key][set.t]
+		if rrset == nil || !now.Before(rrset.deadline) {
+			continue
+		}
+		ds := &dumpSet{Miss: set.miss, Key: set.key, SetKey: set.t, Data: rrset.data, Deadline: rrset.deadline,
+			Rcode: rrset.rcode, Rank: rrset.rank}
+		for _, rr := range rrset.proof {
+			ds.Proof = append(ds.Proof, dumpRecord{Name: packet.EncodeName(rr.Name), Type: rr.Type, Class: rr.Class, Ttl: rr.Ttl, Data: rr.Data})
+		}
+		result = append(result, ds)
+	}
+	return result
+}
+
+// restore adds rrset unless a live set of a higher or the same rank is cached
+func (s *cshard) restore(miss bool, key string, k uint32, rrset *crrset, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	m := s.setMap(miss)
+	if old := m[key][k]; old != nil && now.Before(old.deadline) && old.rank >= rrset.rank {
+		return false
+	}
+	if m[key] == nil {
+		m[key] = make(cmap, 0)
+	}
+	m[key][k] = rrset
+	s.account(miss, key, k)
+	s.enforceLimits(s.sets[csetKey{miss: miss, key: key, t: k}])
+	return true
+}
+
+// rrset converts the dumped set back into its cached form
+func (ds *dumpSet) rrset() (*crrset, error) {
+	if ds.Miss {
+		// negative entries start with the length prefixed SOA owner, see negativeResult()
+		data := ds.Data[0]
+		if len(data) == 0 || int(data[0])+1 > len(data) {
+			return nil, fmt.Errorf("truncated negative entry")
+		}
+		if _, err := packet.ParseName(data[1 : data[0]+1]); err != nil {
+			return nil, err
+		}
+	}
+
+	rrset := &crrset{data: ds.Data, deadline: ds.Deadline, rcode: ds.Rcode, rank: ds.Rank, security: SEC_UNCHECKED}
+	for _, dr := range ds.Proof {
+		name, err := packet.ParseName(dr.Name)
+		if err != nil {
+			return nil, err
+		}
+		rrset.proof = append(rrset.proof, packet.ResourceRecordFormat{Name: name, Type: dr.Type, Class: dr.Class, Ttl: dr.Ttl, Data: dr.Data})
+	}
+	return rrset, nil
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveRestore(t *testing.T) {
+	c := rankTestCache()
+	evictTestPut(c, "long.example", 3600)
+	evictTestPut(c, "short.example", 5)
+	long, _ := packet.ParseTextName("long.example")
+	c.SetSecurity(long, constants.TYPE_A, SEC_SECURE)
+
+	// a negative entry, including its proof
+	name, _ := packet.ParseTextName("nx.example")
+	zone, _ := packet.ParseTextName("example")
+	soa := packet.ResourceRecordFormat{Name: zone, Type: constants.TYPE_SOA, Class: constants.CLASS_IN, Ttl: 300, Data: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}}
+	proof := []packet.ResourceRecordFormat{{Name: zone, Type: constants.TYPE_NSEC, Class: constants.CLASS_IN, Ttl: 300, Data: []byte{0, 0, 6}}}
+	c.injectNegativeItem(InjectSource{Name: name, Type: constants.TYPE_A}, soa, constants.RC_NAME_ERR, proof, RANK_AUTH_AUTHORITY)
+
+	buf := &bytes.Buffer{}
+	if n, err := c.Save(buf); err != nil || n != 3 {
+		panic(fmt.Errorf("Expected to save 3 RRsets, got %d, err=%v", n, err))
+	}
+
+	// short.example expires while we are 'not running'
+	r := NewNameCache()
+	if n, err := r.Restore(buf, time.Now().Add(time.Minute)); err != nil || n != 2 {
+		panic(fmt.Errorf("Expected to restore 2 RRsets, got %d, err=%v", n, err))
+	}
+	if !evictTestCached(r, "long.example") || evictTestCached(r, "short.example") {
+		panic(fmt.Errorf("Restored the wrong RRsets"))
+	}
+	// signatures may have expired in the meantime
+	if rr, _ := r.Lookup(long, constants.TYPE_A); rr.Security != SEC_UNCHECKED {
+		panic(fmt.Errorf("Restored data must be validated again, got security %d", rr.Security))
+	}
+	_, re := r.Lookup(name, constants.TYPE_A)
+	if re == nil || re.ResponseCode != constants.RC_NAME_ERR || len(re.Proof) != 1 || re.Proof[0].Name.ToKey() != zone.ToKey() {
+		panic(fmt.Errorf("Negative entry was not restored: %+v", re))
+	}
+	if st := r.Stats(); st.Entries != 2 {
+		panic(fmt.Errorf("Expected 2 accounted RRsets, got %+v", st))
+	}
+}
+
+func TestSaveFile(t *testing.T) {
+	c := rankTestCache()
+	evictTestPut(c, "file.example", 3600)
+	path := filepath.Join(t.TempDir(), "cache.dump")
+
+	if _, err := c.SaveFile(path); err != nil {
+		panic(err)
+	}
+	r := NewNameCache()
+	if n, err := r.RestoreFile(path); err != nil || n != 1 || !evictTestCached(r, "file.example") {
+		panic(fmt.Errorf("Expected to restore file.example, got %d, err=%v", n, err))
+	}
+
+	if _, err := r.Restore(bytes.NewBufferString("garbage"), time.Now()); err == nil {
+		panic(fmt.Errorf("Restored an invalid dump"))
+	}
+}
+
+func TestRestoreDamaged(t *testing.T) {
+	name, _ := packet.ParseTextName("nx.example")
+	good, _ := packet.ParseTextName("good.example")
+	deadline := time.Now().Add(time.Hour)
+
+	buf := &bytes.Buffer{}
+	enc := gob.NewEncoder(buf)
+	enc.Encode(&dumpHeader{Magic: DUMP_MAGIC, Version: DUMP_VERSION})
+	// the SOA owner claims to be longer than the entry
+	enc.Encode(&dumpSet{Miss: true, Key: name.ToKey(), SetKey: uint32(constants.TYPE_A), Data: [][]byte{{200, 1}}, Deadline: deadline})
+	enc.Encode(&dumpSet{Key: good.ToKey(), SetKey: uint32(constants.TYPE_A), Data: [][]byte{{192, 0, 2, 1}}, Deadline: deadline, Rank: RANK_ANSWER})
+
+	r := NewNameCache()
+	if n, err := r.Restore(buf, time.Now()); err != nil || n != 1 {
+		panic(fmt.Errorf("Expected to restore 1 RRset, got %d, err=%v", n, err))
+	}
+	if _, re := r.Lookup(name, constants.TYPE_A); re != nil {
+		panic(fmt.Errorf("Damaged negative entry was restored: %+v", re))
+	}
+	if !evictTestCached(r, "good.example") {
+		panic(fmt.Errorf("Valid entry after the damaged one was not restored"))
+	}
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	l "github.com/adrian-bl/rna/lib/log"
+	"github.com/adrian-bl/rna/lib/packet"
+	"sync"
+	"time"
+)
+
+// cshard holds all cache entries whose key hashes to it. Each shard has
+// its own lock, so lookups of different names do not contend.
+type cshard struct {
+	sync.RWMutex
+	cache      map[string]cmap   // positive entries
+	miss       map[string]cmap   // negative entries
+	sets       map[csetKey]*cset // size and usage of all cached RRsets
+	bytes      int               // approx. memory used by all sets
+	maxBytes   int               // evict sets if bytes exceeds this value, 0 for no limit
+	maxEntries int               // evict sets if there are more than this, 0 for no limit
+	policy     int               // one of EVICT_*
+	tick       uint64            // incremented on each access, orders sets by their last use. Accessed atomically.
+	age        uint64            // hits of the last set evicted by EVICT_LFU
+	evicted    uint64
+	expired    uint64
+}
+
+func newShard() *cshard {
+	return &cshard{cache: make(map[string]cmap), miss: make(map[string]cmap), sets: make(map[csetKey]*cset), policy: EVICT_LRU}
+}
+
+// shard returns the shard responsible for key (FNV-1a hash)
+func (c *Cache) shard(key string) *cshard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// setMap returns the map holding negative (miss) or positive entries
+func (s *cshard) setMap(miss bool) map[string]cmap {
+	if miss {
+		return s.miss
+	}
+	return s.cache
+}
+
+// inject stores rrset in the positive or negative (miss) entries, atomically
+// replacing the cached set. Live data of a higher rank is never replaced (RFC 2181 5.4.1).
+func (s *cshard) inject(miss bool, rrset []packet.ResourceRecordFormat, rcode uint8, proof []packet.ResourceRecordFormat, rank int) {
+	key := rrset[0].Name.ToKey()
+	k := setKey(rrset[0].Type, rrset[0].Data)
+
+	// all records get the lowest TTL of the set (RFC 2181 5.2)
+	set := &crrset{rcode: rcode, rank: rank, proof: copyRecords(proof)}
+	ttl := rrset[0].Ttl
+	seen := make(map[string]bool)
+	for _, rr := range rrset {
+		if rr.Ttl < ttl {
+			ttl = rr.Ttl
+		}
+		if !seen[string(rr.Data)] {
+			seen[string(rr.Data)] = true
+			cpy := make([]byte, len(rr.Data))
+			copy(cpy, rr.Data)
+			set.data = append(set.data, cpy)
+		}
+	}
+	now := time.Now()
+	set.deadline = now.Add(time.Duration(ttl) * time.Second)
+
+	s.Lock()
+	defer s.Unlock()
+
+	m := s.setMap(miss)
+	if old := m[key][k]; old != nil && now.Before(old.deadline) && old.rank > rank {
+		l.Debug("+ cache keeps higher ranked data, ignoring: %+v", rrset)
+		return
+	}
+
+	l.Debug("+ cache inject: %+v", rrset)
+	if m[key] == nil {
+		m[key] = make(cmap, 0)
+	}
+	m[key][k] = set
+	s.account(miss, key, k)
+	s.enforceLimits(s.sets[csetKey{miss: miss, key: key, t: k}])
+}
@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"time"
+)
+
+// SetStaleWindow keeps expired sets for another window, so they can be served
+// if resolving them again fails (RFC 8767). A window of 0 disables serve-stale.
+// Must be called before the cache is used.
+func (c *Cache) SetStaleWindow(window time.Duration) {
+	c.staleWindow = window
+}
+
+// StaleWindow returns how long expired sets are kept
+func (c *Cache) StaleWindow() time.Duration {
+	return c.staleWindow
+}
+
+// LookupStale works like Lookup, but also returns sets which expired less than
+// the stale window ago. Their records carry a TTL of CACHE_STALE_TTL.
+func (c *Cache) LookupStale(label packet.Namelabel, t uint16) (rr *CacheResult, re *CacheResult) {
+	return c.lookup(label, t, true)
+}
+
+// remaining returns the TTL rrset has left at now. Expired sets are
+// only returned if stale is set and they are within the stale window.
+func (c *Cache) remaining(rrset *crrset, now time.Time, stale bool) (uint32, bool) {
+	if now.Before(rrset.deadline) {
+		return uint32(rrset.deadline.Sub(now).Seconds()), true
+	}
+	if stale && now.Before(rrset.deadline.Add(c.staleWindow)) {
+		return constants.CACHE_STALE_TTL, true
+	}
+	return 0, false
+}
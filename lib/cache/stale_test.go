@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"testing"
+	"time"
+)
+
+func TestLookupStale(t *testing.T) {
+	c := NewShardedCache(1)
+	evictTestPut(c, "stale.example", 60)
+	name, _ := packet.ParseTextName("stale.example")
+	c.shards[0].cache[name.ToKey()][uint32(constants.TYPE_A)].deadline = time.Now().Add(-time.Minute)
+
+	if rr, _ := c.LookupStale(name, constants.TYPE_A); rr != nil {
+		panic(fmt.Errorf("Returned stale data without a stale window: %+v", rr))
+	}
+
+	c.SetStaleWindow(time.Hour)
+	if rr, _ := c.Lookup(name, constants.TYPE_A); rr != nil {
+		panic(fmt.Errorf("Lookup returned stale data: %+v", rr))
+	}
+	rr, _ := c.LookupStale(name, constants.TYPE_A)
+	if rr == nil || len(rr.ResourceRecord) != 1 || rr.ResourceRecord[0].Ttl != constants.CACHE_STALE_TTL {
+		panic(fmt.Errorf("Expected a stale record with TTL %d, got %+v", constants.CACHE_STALE_TTL, rr))
+	}
+
+	// the sweeper keeps the set until the stale window ends
+	if n := c.Sweep(time.Now()); n != 0 {
+		panic(fmt.Errorf("Swept %d sets within the stale window", n))
+	}
+	if n := c.Sweep(time.Now().Add(time.Hour)); n != 1 {
+		panic(fmt.Errorf("Expected to sweep 1 set after the stale window, got %d", n))
+	}
+}
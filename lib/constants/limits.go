@@ -1,8 +1,36 @@
 package constants
 
+import "time"
+
 const MAX_SIZE_LABEL int = 63           // maximum size of a label, excluding dot
 const MAX_SIZE_NAME int = 255           // maximum size of a full dns name
 const MAX_VALUE_TTL uint32 = 0xFFFFFFFF // maximum value of the TTL field
 const MAX_SIZE_UDP int = 512            // max size of an incoming UDP query
+const MAX_SIZE_TCP int = 0xFFFF         // max size of a length-prefixed TCP message
+const MAX_SIZE_EDNS int = 4096          // largest EDNS(0) payload size we are willing to use
+
+const DEFAULT_SIZE_EDNS int = 1232 // default EDNS(0) payload size, avoids IP fragmentation
 
 const FIX_SIZE_HEADER int = 12 // header of a DNS query
+
+const TIMEOUT_LOOKUP = 6500 * time.Millisecond       // deadline to answer a client query
+const TIMEOUT_PRIME_RETRY = 10 * time.Second         // retry interval if priming the root NS set failed
+const TIMEOUT_STALE_ANSWER = 1800 * time.Millisecond // RFC 8767 5: answer with stale data if resolving takes longer
+
+const TIMEOUT_TCP_IDLE = 10 * time.Second    // RFC 7766 6.2.3: close idle client connections
+const TIMEOUT_TCP_WRITE = 5 * time.Second    // give up on clients not reading their replies
+const TIMEOUT_TCP_UPSTREAM = 3 * time.Second // max time to wait for an upstream TCP reply
+const TIMEOUT_UDP_UPSTREAM = 3 * time.Second // max time to wait for an upstream UDP reply
+
+const MAX_CNAME_CHAIN int = 8        // max. number of CNAMEs followed to answer a client query
+const MAX_REFERRAL_DEPTH int = 12    // max. number of referrals followed by a single lookup
+const MAX_UPSTREAM_QUERIES int = 100 // max. number of upstream queries sent to answer a client query
+
+const CACHE_MAX_BYTES int = 64 << 20          // default memory limit of the cache
+const CACHE_MAX_ENTRIES int = 250000          // default max. number of cached RRsets
+const CACHE_SHARDS int = 64                   // number of independently locked parts of the cache
+const CACHE_SWEEP_INTERVAL = 30 * time.Second // interval to purge expired cache entries
+const CACHE_SAVE_INTERVAL = 5 * time.Minute   // interval to write the cache to disk if -cache-file is set
+const STATS_INTERVAL = 5 * time.Minute        // interval to log cache and server queue statistics
+const CACHE_STALE_TTL uint32 = 30             // RFC 8767 4: TTL of stale data served to clients
+const CACHE_BOGUS_TTL = 60 * time.Second      // RFC 4035 4.7: max. time to remember data failing DNSSEC validation
@@ -20,7 +20,19 @@ const (
 	TYPE_MX
 	TYPE_TXT
 
-	TYPE_AAAA = 28
+	TYPE_AAAA   = 28
+	TYPE_SRV    = 33
+	TYPE_NAPTR  = 35
+	TYPE_DNAME  = 39
+	TYPE_OPT    = 41 // EDNS(0) pseudo-RR, RFC 6891
+	TYPE_DS     = 43 // DNSSEC types, RFC 4034 and RFC 5155
+	TYPE_RRSIG  = 46
+	TYPE_NSEC   = 47
+	TYPE_DNSKEY = 48
+	TYPE_NSEC3  = 50
+	TYPE_SVCB   = 64 // RFC 9460
+	TYPE_HTTPS  = 65
+	TYPE_CAA    = 257
 
 	QTYPE_AXFR  = 252
 	QTYPE_MAILB = 253
@@ -51,4 +63,6 @@ const (
 	RC_NAME_ERR
 	RC_NOT_IMPL
 	RC_REFUSED
+
+	RC_BAD_VERS = 16 // extended rcode, RFC 6891 9
 )
@@ -0,0 +1,96 @@
+package dnssec
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The DS records of the root zone KSKs, as published
+// by IANA on https://data.iana.org/root-anchors/
+var rootAnchors = []string{
+	"20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D", // KSK-2017
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16", // KSK-2024
+}
+
+// RootAnchors returns the built-in trust anchors of the root zone
+func RootAnchors() []*Ds {
+	anchors := make([]*Ds, 0)
+	for _, s := range rootAnchors {
+		ds, err := parseDsText(strings.Fields(s))
+		if err != nil {
+			panic(err)
+		}
+		anchors = append(anchors, ds)
+	}
+	return anchors
+}
+
+// ParseTrustAnchors reads root DS records in presentation format, such as
+// `. IN DS 20326 8 2 E06D44B8...'. Empty lines and comments are ignored.
+func ParseTrustAnchors(r io.Reader) ([]*Ds, error) {
+	anchors := make([]*Ds, 0)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "." {
+			return nil, fmt.Errorf("line %d: only root trust anchors are supported", n)
+		}
+
+		// skip optional TTL and class fields up to the type
+		i := 1
+		for i < len(fields) && strings.ToUpper(fields[i]) != "DS" {
+			i++
+		}
+		if i+4 > len(fields) {
+			return nil, fmt.Errorf("line %d: not a DS record", n)
+		}
+		ds, err := parseDsText(fields[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		anchors = append(anchors, ds)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("No trust anchors found")
+	}
+	return anchors, nil
+}
+
+// parseDsText parses the presentation format of DS RDATA.
+// The digest may be split into multiple fields.
+func parseDsText(fields []string) (*Ds, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("DS record too short")
+	}
+	tag, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	alg, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	dtype, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, err
+	}
+	return &Ds{KeyTag: uint16(tag), Algorithm: uint8(alg), DigestType: uint8(dtype), Digest: digest}, nil
+}
@@ -0,0 +1,275 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"strings"
+)
+
+// Upper limit of NSEC3 iterations we are willing to calculate.
+// Proofs using more iterations are rejected (RFC 9276 3.2)
+const MAX_NSEC3_ITERATIONS = 150
+
+var b32hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// CheckDenial verifies that the NSEC or NSEC3 records in proof deny the
+// existence of qtype at qname (nxdomain == false) or of qname itself.
+// The signatures of the proof must be validated by the caller.
+// optOut is set if the proof relies on an NSEC3 opt-out span, which
+// only proves that no secure delegation exists.
+func CheckDenial(qname packet.Namelabel, qtype uint16, nxdomain bool, proof []packet.ResourceRecordFormat) (optOut bool, err error) {
+	if nsecs := filterRecords(proof, constants.TYPE_NSEC); len(nsecs) > 0 {
+		if nxdomain {
+			return false, checkNsecNameError(qname, nsecs)
+		}
+		return false, checkNsecNoData(qname, qtype, nsecs)
+	}
+	if nsec3s := filterRecords(proof, constants.TYPE_NSEC3); len(nsec3s) > 0 {
+		return checkNsec3(qname, qtype, nxdomain, nsec3s)
+	}
+	return false, fmt.Errorf("No NSEC or NSEC3 records found")
+}
+
+// CheckWildcard verifies that the NSEC or NSEC3 records in proof show that no closer
+// match exists for owner, the name of an RRset expanded from a wildcard with the given
+// number of labels (RFC 4035 5.3.4, RFC 5155 8.8). The signatures of the proof must be
+// validated by the caller.
+func CheckWildcard(owner packet.Namelabel, labels uint8, proof []packet.ResourceRecordFormat) error {
+	count := owner.Len() - 1 // don't count the root label
+	if int(labels) >= count {
+		return fmt.Errorf("%v was not expanded from a wildcard", &owner)
+	}
+
+	if nsecs := filterRecords(proof, constants.TYPE_NSEC); len(nsecs) > 0 {
+		for _, rr := range nsecs {
+			n, err := ParseNsec(rr.Data)
+			if err == nil && nsecCovers(rr.Name, n.NextName, owner) {
+				return nil
+			}
+		}
+		return fmt.Errorf("No NSEC record covers %v", &owner)
+	}
+	if nsec3s := filterRecords(proof, constants.TYPE_NSEC3); len(nsec3s) > 0 {
+		records, err := parseNsec3Records(nsec3s)
+		if err != nil {
+			return err
+		}
+		// the closest encloser is the parent of the wildcard, the next closer name is one label longer
+		nextCloser := owner.PoppedLabel(count - int(labels) - 1)
+		if nsec3Cover(records, *nextCloser) == nil {
+			return fmt.Errorf("Next closer name %v is not covered", nextCloser)
+		}
+		return nil
+	}
+	return fmt.Errorf("No NSEC or NSEC3 records found")
+}
+
+// checkNsecNoData verifies that an NSEC record owned by qname lacks qtype
+func checkNsecNoData(qname packet.Namelabel, qtype uint16, nsecs []packet.ResourceRecordFormat) error {
+	for _, rr := range nsecs {
+		if rr.Name.ToKey() != qname.ToKey() {
+			continue
+		}
+		n, err := ParseNsec(rr.Data)
+		if err != nil {
+			return err
+		}
+		return checkTypes(n.Types, qtype)
+	}
+	return fmt.Errorf("No matching NSEC record for NODATA proof")
+}
+
+// checkNsecNameError verifies that qname and the wildcard of its
+// closest encloser are covered by NSEC records (RFC 4035 5.4)
+func checkNsecNameError(qname packet.Namelabel, nsecs []packet.ResourceRecordFormat) error {
+	var encloser *packet.Namelabel
+	for _, rr := range nsecs {
+		n, err := ParseNsec(rr.Data)
+		if err == nil && nsecCovers(rr.Name, n.NextName, qname) {
+			// the closest encloser is the longest ancestor shared with either end of the span
+			ea := commonAncestor(qname, rr.Name)
+			eb := commonAncestor(qname, n.NextName)
+			encloser = ea
+			if eb.Len() > ea.Len() {
+				encloser = eb
+			}
+			break
+		}
+	}
+	if encloser == nil {
+		return fmt.Errorf("No NSEC record covers %v", qname)
+	}
+
+	wildcard, err := packet.ParseName(append([]byte{1, '*'}, packet.EncodeName(*encloser)...))
+	if err != nil {
+		return err
+	}
+	for _, rr := range nsecs {
+		n, err := ParseNsec(rr.Data)
+		if err == nil && nsecCovers(rr.Name, n.NextName, wildcard) {
+			return nil
+		}
+	}
+	return fmt.Errorf("No NSEC record denies wildcard %v", wildcard)
+}
+
+// nsecCovers returns true if name sorts between owner and next
+func nsecCovers(owner packet.Namelabel, next packet.Namelabel, name packet.Namelabel) bool {
+	if owner.Compare(&next) < 0 {
+		return owner.Compare(&name) < 0 && name.Compare(&next) < 0
+	}
+	// last NSEC in the zone: next points back to the apex
+	return owner.Compare(&name) < 0 || name.Compare(&next) < 0
+}
+
+// commonAncestor returns the longest name which is a parent of (or equal to) a and b
+func commonAncestor(a packet.Namelabel, b packet.Namelabel) *packet.Namelabel {
+	for i := 0; i < a.Len(); i++ {
+		anc := a.PoppedLabel(i)
+		if b.IsChildOf(anc) {
+			return anc
+		}
+	}
+	return a.PoppedLabel(a.Len() - 1)
+}
+
+// checkTypes returns an error if types includes qtype or a CNAME
+func checkTypes(types map[uint16]bool, qtype uint16) error {
+	if types[qtype] || types[constants.TYPE_CNAME] {
+		return fmt.Errorf("Type %d exists according to the denial record", qtype)
+	}
+	// DS records live in the parent: a record with SOA set is from the wrong side of the cut
+	if qtype == constants.TYPE_DS && types[constants.TYPE_SOA] {
+		return fmt.Errorf("DS denial made by the child zone")
+	}
+	// a missing DS set only proves an insecure delegation if there is a delegation (RFC 4035 5.2, RFC 5155 8.9)
+	if qtype == constants.TYPE_DS && !types[constants.TYPE_NS] {
+		return fmt.Errorf("DS denial for a name which is not a delegation")
+	}
+	return nil
+}
+
+// nsec3Record is a parsed NSEC3 RR along with its decoded owner hash
+type nsec3Record struct {
+	owner []byte
+	zone  *packet.Namelabel
+	rdata *Nsec3
+}
+
+// parseNsec3Records parses the NSEC3 RRs in rrs, rejecting unsupported parameters
+func parseNsec3Records(rrs []packet.ResourceRecordFormat) ([]*nsec3Record, error) {
+	records := make([]*nsec3Record, 0)
+	for _, rr := range rrs {
+		n, err := ParseNsec3(rr.Data)
+		if err != nil {
+			return nil, err
+		}
+		if n.HashAlgorithm != 1 || n.Iterations > MAX_NSEC3_ITERATIONS {
+			return nil, fmt.Errorf("Unsupported NSEC3 parameters")
+		}
+		wire := packet.EncodeName(rr.Name)
+		if len(wire) < 2 || rr.Name.Len() < 2 {
+			return nil, fmt.Errorf("Invalid NSEC3 owner")
+		}
+		owner, err := b32hex.DecodeString(strings.ToUpper(string(wire[1 : 1+wire[0]])))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &nsec3Record{owner: owner, zone: rr.Name.PoppedLabel(1), rdata: n})
+	}
+	return records, nil
+}
+
+// checkNsec3 implements the NSEC3 proofs of RFC 5155 8.4 - 8.6
+func checkNsec3(qname packet.Namelabel, qtype uint16, nxdomain bool, rrs []packet.ResourceRecordFormat) (bool, error) {
+	records, err := parseNsec3Records(rrs)
+	if err != nil {
+		return false, err
+	}
+
+	if !nxdomain {
+		if r := nsec3Match(records, qname); r != nil {
+			return false, checkTypes(r.rdata.Types, qtype)
+		}
+		if qtype != constants.TYPE_DS {
+			return false, fmt.Errorf("No matching NSEC3 record for NODATA proof")
+		}
+		// no match for a DS query: this must be an opt-out span (RFC 5155 8.6)
+	}
+
+	// closest encloser proof (RFC 5155 7.2.1)
+	for i := 1; i < qname.Len(); i++ {
+		encloser := qname.PoppedLabel(i)
+		if nsec3Match(records, *encloser) == nil {
+			continue
+		}
+		nc := nsec3Cover(records, *qname.PoppedLabel(i - 1))
+		if nc == nil {
+			return false, fmt.Errorf("Next closer name of %v is not covered", qname)
+		}
+		if !nxdomain {
+			if !nc.rdata.OptOut() {
+				return false, fmt.Errorf("DS denial without opt-out")
+			}
+			return true, nil
+		}
+
+		wildcard, err := packet.ParseName(append([]byte{1, '*'}, packet.EncodeName(*encloser)...))
+		if err != nil {
+			return false, err
+		}
+		if nsec3Cover(records, wildcard) == nil {
+			return false, fmt.Errorf("No NSEC3 record denies wildcard %v", wildcard)
+		}
+		return nc.rdata.OptOut(), nil
+	}
+	return false, fmt.Errorf("No closest encloser found for %v", qname)
+}
+
+// nsec3Match returns the record whose owner hash equals the hash of name
+func nsec3Match(records []*nsec3Record, name packet.Namelabel) *nsec3Record {
+	for _, r := range records {
+		if name.IsChildOf(r.zone) && bytes.Equal(r.owner, HashName(name, r.rdata.Iterations, r.rdata.Salt)) {
+			return r
+		}
+	}
+	return nil
+}
+
+// nsec3Cover returns the record whose span covers the hash of name
+func nsec3Cover(records []*nsec3Record, name packet.Namelabel) *nsec3Record {
+	for _, r := range records {
+		if !name.IsChildOf(r.zone) {
+			continue
+		}
+		h := HashName(name, r.rdata.Iterations, r.rdata.Salt)
+		next := r.rdata.NextHashed
+		if bytes.Compare(r.owner, next) < 0 {
+			if bytes.Compare(r.owner, h) < 0 && bytes.Compare(h, next) < 0 {
+				return r
+			}
+		} else if bytes.Compare(r.owner, h) < 0 || bytes.Compare(h, next) < 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+// HashName returns the NSEC3 SHA-1 hash of name (RFC 5155 5)
+func HashName(name packet.Namelabel, iterations uint16, salt []byte) []byte {
+	h := sha1.New()
+	h.Write(canonicalName(name))
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := uint16(0); i < iterations; i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(nil)
+	}
+	return digest
+}
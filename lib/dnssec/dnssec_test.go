@@ -0,0 +1,266 @@
+package dnssec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"strings"
+	"testing"
+	"time"
+)
+
+// toName converts a dotted string into a Namelabel
+func toName(s string) packet.Namelabel {
+	wire := make([]byte, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		if label != "" {
+			wire = append(wire, byte(len(label)))
+			wire = append(wire, label...)
+		}
+	}
+	n, err := packet.ParseName(append(wire, 0))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// RFC 5155 Appendix A
+func TestNsec3Hash(t *testing.T) {
+	salt, _ := hex.DecodeString("aabbccdd")
+	h := HashName(toName("example."), 12, salt)
+	if enc := strings.ToLower(base32.HexEncoding.EncodeToString(h)); enc != "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom" {
+		panic(fmt.Errorf("Unexpected hash: %s", enc))
+	}
+}
+
+// RFC 4034 5.4
+func TestDsDigest(t *testing.T) {
+	raw, _ := base64.StdEncoding.DecodeString("AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvxegXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw==")
+	key, err := ParseDnskey(append([]byte{0x01, 0x00, 3, ALG_RSASHA1}, raw...))
+	if err != nil {
+		panic(err)
+	}
+	if key.KeyTag() != 60485 {
+		panic(fmt.Errorf("Unexpected key tag %d", key.KeyTag()))
+	}
+
+	digest, _ := hex.DecodeString("2BB183AF5F22588179A53B0A98631FAD1A292118")
+	ds := &Ds{KeyTag: 60485, Algorithm: ALG_RSASHA1, DigestType: DIGEST_SHA1, Digest: digest}
+	if !ds.Matches(toName("dskey.example.com."), key) {
+		panic(fmt.Errorf("DS should match the key"))
+	}
+	if ds.Matches(toName("example.com."), key) {
+		panic(fmt.Errorf("DS must not match for a different owner"))
+	}
+}
+
+// signRRset returns an RRSIG over rrset, using sign to create the signature
+func signRRset(rrset []packet.ResourceRecordFormat, key *Dnskey, signer string, sign func([]byte) []byte) *Rrsig {
+	now := uint32(time.Now().Unix())
+	sig := &Rrsig{TypeCovered: rrset[0].Type, Algorithm: key.Algorithm, Labels: uint8(rrset[0].Name.Len() - 1),
+		OrigTtl: 3600, Expiration: now + 3600, Inception: now - 3600, KeyTag: key.KeyTag(), SignerName: toName(signer)}
+	sig.Signature = sign(signedData(rrset, sig, rrset[0].Name))
+	return sig
+}
+
+func testRRset() []packet.ResourceRecordFormat {
+	return []packet.ResourceRecordFormat{
+		{Name: toName("WWW.example.com."), Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 2}},
+		{Name: toName("www.example.com."), Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 60, Data: []byte{192, 0, 2, 1}},
+	}
+}
+
+func TestVerifyEcdsa(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pub := append(priv.PublicKey.X.FillBytes(make([]byte, 32)), priv.PublicKey.Y.FillBytes(make([]byte, 32))...)
+	key, _ := ParseDnskey(append([]byte{0x01, 0x01, 3, ALG_ECDSAP256SHA256}, pub...))
+
+	rrset := testRRset()
+	sig := signRRset(rrset, key, "example.com.", func(data []byte) []byte {
+		h := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, h[:])
+		if err != nil {
+			panic(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	})
+
+	// order and case of the records must not matter
+	if err := Verify([]packet.ResourceRecordFormat{rrset[1], rrset[0]}, sig, key, time.Now()); err != nil {
+		panic(err)
+	}
+
+	rrset[0].Data = []byte{192, 0, 2, 3}
+	if err := Verify(rrset, sig, key, time.Now()); err == nil {
+		panic(fmt.Errorf("Modified RRset must not verify"))
+	}
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ParseDnskey(append([]byte{0x01, 0x01, 3, ALG_ED25519}, pub...))
+
+	rrset := testRRset()
+	sig := signRRset(rrset, key, "example.com.", func(data []byte) []byte {
+		s, _ := priv.Sign(rand.Reader, data, crypto.Hash(0))
+		return s
+	})
+	if err := Verify(rrset, sig, key, time.Now()); err != nil {
+		panic(err)
+	}
+	if err := Verify(rrset, sig, key, time.Now().Add(2*time.Hour)); err == nil {
+		panic(fmt.Errorf("Expired signature must not verify"))
+	}
+
+	// a signature of the wildcard must validate the expanded name
+	wild := []packet.ResourceRecordFormat{{Name: toName("*.example.com."), Type: constants.TYPE_A, Class: constants.CLASS_IN, Data: []byte{1, 2, 3, 4}}}
+	wsig := signRRset(wild, key, "example.com.", func(data []byte) []byte {
+		s, _ := priv.Sign(rand.Reader, data, crypto.Hash(0))
+		return s
+	})
+	wsig.Labels = 2
+	wsig.Signature, _ = priv.Sign(rand.Reader, signedData(wild, wsig, wild[0].Name), crypto.Hash(0))
+	wild[0].Name = toName("foo.example.com.")
+	if err := Verify(wild, wsig, key, time.Now()); err != nil {
+		panic(err)
+	}
+}
+
+// nsecRecord returns an NSEC record owned by owner, pointing to next
+func nsecRecord(owner string, next string, types ...uint16) packet.ResourceRecordFormat {
+	data := packet.EncodeName(toName(next))
+	bitmap := make([]byte, 32)
+	for _, t := range types {
+		bitmap[t/8] |= 0x80 >> (t % 8)
+	}
+	blen := 32
+	for blen > 1 && bitmap[blen-1] == 0 {
+		blen--
+	}
+	data = append(data, 0, byte(blen))
+	data = append(data, bitmap[:blen]...)
+	return packet.ResourceRecordFormat{Name: toName(owner), Type: constants.TYPE_NSEC, Class: constants.CLASS_IN, Data: data}
+}
+
+func TestNsecDenial(t *testing.T) {
+	proof := []packet.ResourceRecordFormat{
+		nsecRecord("example.com.", "b.example.com.", constants.TYPE_NS, constants.TYPE_SOA),
+		nsecRecord("b.example.com.", "d.example.com.", constants.TYPE_A),
+	}
+
+	if _, err := CheckDenial(toName("b.example.com."), constants.TYPE_AAAA, false, proof); err != nil {
+		panic(err)
+	}
+	if _, err := CheckDenial(toName("b.example.com."), constants.TYPE_A, false, proof); err == nil {
+		panic(fmt.Errorf("Existing type must not be denied"))
+	}
+	if _, err := CheckDenial(toName("c.example.com."), constants.TYPE_A, true, proof); err != nil {
+		panic(err)
+	}
+	if _, err := CheckDenial(toName("e.example.com."), constants.TYPE_A, true, proof); err == nil {
+		panic(fmt.Errorf("Uncovered name must not be denied"))
+	}
+	if _, err := CheckDenial(toName("example.com."), constants.TYPE_DS, false, proof); err == nil {
+		panic(fmt.Errorf("DS denial from the child zone must be rejected"))
+	}
+}
+
+func TestNsecDsDenial(t *testing.T) {
+	proof := []packet.ResourceRecordFormat{
+		nsecRecord("sub.example.com.", "www.example.com.", constants.TYPE_NS, constants.TYPE_RRSIG, constants.TYPE_NSEC),
+		nsecRecord("www.example.com.", "z.example.com.", constants.TYPE_A, constants.TYPE_RRSIG, constants.TYPE_NSEC),
+	}
+
+	if _, err := CheckDenial(toName("sub.example.com."), constants.TYPE_DS, false, proof); err != nil {
+		panic(err)
+	}
+	// www.example.com is no delegation: this must not prove that it is an unsigned zone
+	if _, err := CheckDenial(toName("www.example.com."), constants.TYPE_DS, false, proof); err == nil {
+		panic(fmt.Errorf("DS denial without the NS bit must be rejected"))
+	}
+}
+
+func TestNsec3NoData(t *testing.T) {
+	name := toName("example.")
+	data := []byte{1, 0, 0, 0, 0, 20}
+	next := make([]byte, 20)
+	binary.BigEndian.PutUint32(next, 0xFFFFFFFF)
+	data = append(data, next...)
+	data = append(data, 0, 1, 0x40) // only A exists
+	owner := strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(HashName(name, 0, nil)))
+
+	proof := []packet.ResourceRecordFormat{{Name: toName(owner + ".example."), Type: constants.TYPE_NSEC3, Class: constants.CLASS_IN, Data: data}}
+	if _, err := CheckDenial(name, constants.TYPE_MX, false, proof); err != nil {
+		panic(err)
+	}
+	if _, err := CheckDenial(name, constants.TYPE_A, false, proof); err == nil {
+		panic(fmt.Errorf("Existing type must not be denied"))
+	}
+	if _, err := CheckDenial(name, constants.TYPE_DS, false, proof); err == nil {
+		panic(fmt.Errorf("DS denial without the NS bit must be rejected"))
+	}
+}
+
+func TestCheckWildcard(t *testing.T) {
+	// foo.bar.example.com expanded from *.example.com
+	owner := toName("foo.bar.example.com.")
+	proof := []packet.ResourceRecordFormat{nsecRecord("d.example.com.", "f.example.com.", constants.TYPE_A)}
+	if err := CheckWildcard(owner, 2, proof); err == nil {
+		panic(fmt.Errorf("Uncovered name must be rejected"))
+	}
+	proof = append(proof, nsecRecord("a.example.com.", "c.example.com.", constants.TYPE_A))
+	if err := CheckWildcard(owner, 2, proof); err != nil {
+		panic(err)
+	}
+	if err := CheckWildcard(owner, 4, proof); err == nil {
+		panic(fmt.Errorf("Name which was not expanded must be rejected"))
+	}
+	if err := CheckWildcard(owner, 2, nil); err == nil {
+		panic(fmt.Errorf("Missing proof must be rejected"))
+	}
+
+	// NSEC3 must cover the next closer name bar.example.com, not the owner itself
+	h := HashName(toName("bar.example.com."), 0, nil)
+	start := append(append([]byte{}, h[:19]...), 0x00)
+	data := append([]byte{1, 0, 0, 0, 0, 20}, h[:19]...)
+	data = append(data, 0xFF, 0, 1, 0x40)
+	label := strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(start))
+	nsec3 := []packet.ResourceRecordFormat{{Name: toName(label + ".example.com."), Type: constants.TYPE_NSEC3, Class: constants.CLASS_IN, Data: data}}
+	if err := CheckWildcard(owner, 2, nsec3); err != nil {
+		panic(err)
+	}
+	if err := CheckWildcard(owner, 1, nsec3); err == nil {
+		panic(fmt.Errorf("NSEC3 not covering the next closer name must be rejected"))
+	}
+}
+
+func TestTrustAnchors(t *testing.T) {
+	anchors := RootAnchors()
+	if len(anchors) != 2 || anchors[0].KeyTag != 20326 || len(anchors[0].Digest) != 32 {
+		panic(fmt.Errorf("Unexpected built-in anchors: %+v", anchors))
+	}
+
+	input := "; comment\n. 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D084 58E880409BBC683457104237C7F8EC8D\n"
+	parsed, err := ParseTrustAnchors(strings.NewReader(input))
+	if err != nil {
+		panic(err)
+	}
+	if len(parsed) != 1 || hex.EncodeToString(parsed[0].Digest) != hex.EncodeToString(anchors[0].Digest) {
+		panic(fmt.Errorf("Unexpected anchor: %+v", parsed))
+	}
+
+	if _, err := ParseTrustAnchors(strings.NewReader("com. IN DS 1 8 2 AA\n")); err == nil {
+		panic(fmt.Errorf("Non-root anchors must be rejected"))
+	}
+}
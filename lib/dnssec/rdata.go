@@ -0,0 +1,226 @@
+package dnssec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+)
+
+// RRSIG RDATA as defined in RFC 4034 3.1
+type Rrsig struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OrigTtl     uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  packet.Namelabel
+	Signature   []byte
+}
+
+// DNSKEY RDATA as defined in RFC 4034 2.1
+type Dnskey struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+	rdata     []byte // raw rdata, used to calculate the key tag and DS digests
+}
+
+// DS RDATA as defined in RFC 4034 5.1
+type Ds struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// NSEC RDATA as defined in RFC 4034 4.1
+type Nsec struct {
+	NextName packet.Namelabel
+	Types    map[uint16]bool
+}
+
+// NSEC3 RDATA as defined in RFC 5155 3.2
+type Nsec3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         map[uint16]bool
+}
+
+// ParseRrsig parses the RDATA of an RRSIG record
+func ParseRrsig(data []byte) (*Rrsig, error) {
+	if len(data) < 19 {
+		return nil, fmt.Errorf("Short RRSIG record")
+	}
+	s := &Rrsig{}
+	s.TypeCovered = binary.BigEndian.Uint16(data[0:])
+	s.Algorithm = data[2]
+	s.Labels = data[3]
+	s.OrigTtl = binary.BigEndian.Uint32(data[4:])
+	s.Expiration = binary.BigEndian.Uint32(data[8:])
+	s.Inception = binary.BigEndian.Uint32(data[12:])
+	s.KeyTag = binary.BigEndian.Uint16(data[16:])
+
+	name, err := packet.ParseName(data[18:])
+	if err != nil {
+		return nil, err
+	}
+	s.SignerName = name
+	s.Signature = data[18+len(packet.EncodeName(name)):]
+	return s, nil
+}
+
+// ParseDnskey parses the RDATA of a DNSKEY record
+func ParseDnskey(data []byte) (*Dnskey, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("Short DNSKEY record")
+	}
+	k := &Dnskey{}
+	k.Flags = binary.BigEndian.Uint16(data[0:])
+	k.Protocol = data[2]
+	k.Algorithm = data[3]
+	k.PublicKey = data[4:]
+	k.rdata = data
+	return k, nil
+}
+
+// ParseDs parses the RDATA of a DS record
+func ParseDs(data []byte) (*Ds, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("Short DS record")
+	}
+	d := &Ds{}
+	d.KeyTag = binary.BigEndian.Uint16(data[0:])
+	d.Algorithm = data[2]
+	d.DigestType = data[3]
+	d.Digest = data[4:]
+	return d, nil
+}
+
+// ParseNsec parses the RDATA of an NSEC record
+func ParseNsec(data []byte) (*Nsec, error) {
+	name, err := packet.ParseName(data)
+	if err != nil {
+		return nil, err
+	}
+	types, err := parseTypeBitmap(data[len(packet.EncodeName(name)):])
+	if err != nil {
+		return nil, err
+	}
+	return &Nsec{NextName: name, Types: types}, nil
+}
+
+// ParseNsec3 parses the RDATA of an NSEC3 record
+func ParseNsec3(data []byte) (*Nsec3, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("Short NSEC3 record")
+	}
+	n := &Nsec3{}
+	n.HashAlgorithm = data[0]
+	n.Flags = data[1]
+	n.Iterations = binary.BigEndian.Uint16(data[2:])
+
+	c := 4
+	slen := int(data[c])
+	c++
+	if c+slen+1 > len(data) {
+		return nil, fmt.Errorf("Invalid NSEC3 salt length")
+	}
+	n.Salt = data[c : c+slen]
+	c += slen
+
+	hlen := int(data[c])
+	c++
+	if c+hlen > len(data) {
+		return nil, fmt.Errorf("Invalid NSEC3 hash length")
+	}
+	n.NextHashed = data[c : c+hlen]
+	c += hlen
+
+	types, err := parseTypeBitmap(data[c:])
+	if err != nil {
+		return nil, err
+	}
+	n.Types = types
+	return n, nil
+}
+
+// OptOut returns true if the opt-out flag of this NSEC3 record is set
+func (n *Nsec3) OptOut() bool {
+	return n.Flags&1 != 0
+}
+
+// parseTypeBitmap decodes the window blocks of an NSEC(3) type bitmap (RFC 4034 4.1.2)
+func parseTypeBitmap(data []byte) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+	for c := 0; c < len(data); {
+		if c+2 > len(data) {
+			return nil, fmt.Errorf("Short type bitmap")
+		}
+		window := uint16(data[c]) << 8
+		blen := int(data[c+1])
+		c += 2
+		if blen == 0 || blen > 32 || c+blen > len(data) {
+			return nil, fmt.Errorf("Invalid type bitmap length %d", blen)
+		}
+		for i := 0; i < blen; i++ {
+			for bit := 0; bit < 8; bit++ {
+				if data[c+i]&(0x80>>uint(bit)) != 0 {
+					types[window|uint16(i*8+bit)] = true
+				}
+			}
+		}
+		c += blen
+	}
+	return types, nil
+}
+
+// IsZoneKey returns true if this key may be used to verify RRSIGs
+func (k *Dnskey) IsZoneKey() bool {
+	return k.Flags&(1<<8) != 0 && k.Protocol == 3
+}
+
+// KeyTag returns the key tag of k as defined in RFC 4034 Appendix B
+func (k *Dnskey) KeyTag() uint16 {
+	var ac uint32
+	for i, b := range k.rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac & 0xFFFF)
+}
+
+// filterRecords returns all records of rrs with the given type
+func filterRecords(rrs []packet.ResourceRecordFormat, t uint16) []packet.ResourceRecordFormat {
+	result := make([]packet.ResourceRecordFormat, 0)
+	for _, rr := range rrs {
+		if rr.Type == t {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
+
+// SignaturesFor returns the parsed RRSIGs of rrs which cover
+// the given owner name and type
+func SignaturesFor(rrs []packet.ResourceRecordFormat, owner packet.Namelabel, t uint16) []*Rrsig {
+	result := make([]*Rrsig, 0)
+	key := owner.ToKey()
+	for _, rr := range filterRecords(rrs, constants.TYPE_RRSIG) {
+		sig, err := ParseRrsig(rr.Data)
+		if err == nil && sig.TypeCovered == t && rr.Name.ToKey() == key {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
@@ -0,0 +1,285 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"hash"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// DNSSEC algorithm numbers (RFC 8624)
+const (
+	ALG_RSASHA1         = 5
+	ALG_RSASHA1_NSEC3   = 7
+	ALG_RSASHA256       = 8
+	ALG_RSASHA512       = 10
+	ALG_ECDSAP256SHA256 = 13
+	ALG_ECDSAP384SHA384 = 14
+	ALG_ED25519         = 15
+)
+
+// DS digest types
+const (
+	DIGEST_SHA1   = 1
+	DIGEST_SHA256 = 2
+	DIGEST_SHA384 = 4
+)
+
+// AlgorithmSupported returns true if we are able to verify
+// signatures made with given algorithm. Zones signed only with
+// unsupported algorithms are treated as insecure (RFC 4035 5.2)
+func AlgorithmSupported(alg uint8) bool {
+	switch alg {
+	case ALG_RSASHA1, ALG_RSASHA1_NSEC3, ALG_RSASHA256, ALG_RSASHA512, ALG_ECDSAP256SHA256, ALG_ECDSAP384SHA384, ALG_ED25519:
+		return true
+	}
+	return false
+}
+
+// DigestSupported returns true if we are able to check DS records of this digest type
+func DigestSupported(t uint8) bool {
+	return t == DIGEST_SHA1 || t == DIGEST_SHA256 || t == DIGEST_SHA384
+}
+
+// Matches returns true if ds is a digest of key, owned by zone
+func (ds *Ds) Matches(zone packet.Namelabel, key *Dnskey) bool {
+	if ds.Algorithm != key.Algorithm || ds.KeyTag != key.KeyTag() {
+		return false
+	}
+
+	var h hash.Hash
+	switch ds.DigestType {
+	case DIGEST_SHA1:
+		h = sha1.New()
+	case DIGEST_SHA256:
+		h = sha256.New()
+	case DIGEST_SHA384:
+		h = sha512.New384()
+	default:
+		return false
+	}
+	h.Write(canonicalName(zone))
+	h.Write(key.rdata)
+	return bytes.Equal(h.Sum(nil), ds.Digest)
+}
+
+// Verify checks that sig is a valid signature over rrset, made by key at time now.
+// All records of rrset are expected to share the same owner, type and class.
+func Verify(rrset []packet.ResourceRecordFormat, sig *Rrsig, key *Dnskey, now time.Time) error {
+	if len(rrset) == 0 {
+		return fmt.Errorf("Empty RRset")
+	}
+	if !key.IsZoneKey() || sig.Algorithm != key.Algorithm || sig.KeyTag != key.KeyTag() {
+		return fmt.Errorf("Signature was not made by this key")
+	}
+	if sig.TypeCovered != rrset[0].Type {
+		return fmt.Errorf("Signature covers type %d, not %d", sig.TypeCovered, rrset[0].Type)
+	}
+
+	// serial number arithmetic as timestamps wrap in 2106 (RFC 4034 3.1.5)
+	ts := uint32(now.Unix())
+	if int32(ts-sig.Inception) < 0 || int32(sig.Expiration-ts) < 0 {
+		return fmt.Errorf("Signature is not valid at this time")
+	}
+
+	owner, err := signedOwner(rrset[0].Name, sig.Labels)
+	if err != nil {
+		return err
+	}
+
+	data := signedData(rrset, sig, owner)
+	return verifySignature(sig.Algorithm, key.PublicKey, data, sig.Signature)
+}
+
+// WildcardExpanded returns true if an RRset owned by owner and covered by an RRSIG
+// with the given labels field was synthesized from a wildcard. Such answers are only
+// valid along with a proof that no closer match exists, see CheckWildcard().
+func WildcardExpanded(owner packet.Namelabel, labels uint8) bool {
+	return int(labels) < ownerLabels(owner)
+}
+
+// ownerLabels returns the number of labels of owner, as counted by the RRSIG labels field
+func ownerLabels(owner packet.Namelabel) int {
+	wire := packet.EncodeName(owner)
+	count := owner.Len() - 1 // don't count the root label
+	if len(wire) > 2 && wire[0] == 1 && wire[1] == '*' {
+		count--
+	}
+	return count
+}
+
+// signedOwner returns the owner name used to calculate the signature.
+// This is the wildcard name if the record was synthesized (RFC 4035 5.3.2)
+func signedOwner(owner packet.Namelabel, labels uint8) (packet.Namelabel, error) {
+	count := ownerLabels(owner)
+	switch {
+	case int(labels) > count:
+		return owner, fmt.Errorf("RRSIG labels field exceeds owner name")
+	case int(labels) < count:
+		wild := append([]byte{1, '*'}, packet.EncodeName(*owner.PoppedLabel(count - int(labels)))...)
+		return packet.ParseName(wild)
+	}
+	return owner, nil
+}
+
+// signedData returns the data covered by sig (RFC 4034 3.1.8.1)
+func signedData(rrset []packet.ResourceRecordFormat, sig *Rrsig, owner packet.Namelabel) []byte {
+	buf := make([]byte, 18)
+	binary.BigEndian.PutUint16(buf[0:], sig.TypeCovered)
+	buf[2] = sig.Algorithm
+	buf[3] = sig.Labels
+	binary.BigEndian.PutUint32(buf[4:], sig.OrigTtl)
+	binary.BigEndian.PutUint32(buf[8:], sig.Expiration)
+	binary.BigEndian.PutUint32(buf[12:], sig.Inception)
+	binary.BigEndian.PutUint16(buf[16:], sig.KeyTag)
+	buf = append(buf, canonicalName(sig.SignerName)...)
+
+	// RRs are sorted by their canonical RDATA, duplicates are removed (RFC 4034 6.3)
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdatas = append(rdatas, canonicalRdata(rr.Type, rr.Data))
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	prefix := canonicalName(owner)
+	prefix = append(prefix, make([]byte, 10)...)
+	binary.BigEndian.PutUint16(prefix[len(prefix)-10:], rrset[0].Type)
+	binary.BigEndian.PutUint16(prefix[len(prefix)-8:], rrset[0].Class)
+	binary.BigEndian.PutUint32(prefix[len(prefix)-6:], sig.OrigTtl)
+
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		buf = append(buf, prefix[:len(prefix)-2]...)
+		buf = append(buf, byte(len(rdata)>>8), byte(len(rdata)))
+		buf = append(buf, rdata...)
+	}
+	return buf
+}
+
+// canonicalName returns the uncompressed, lowercased wire format of name
+func canonicalName(name packet.Namelabel) []byte {
+	wire := packet.EncodeName(name)
+	lowerName(wire, 0)
+	return wire
+}
+
+// canonicalRdata returns a copy of data with all embedded
+// domain names converted to lowercase (RFC 4034 6.2)
+func canonicalRdata(t uint16, data []byte) []byte {
+	cpy := make([]byte, len(data))
+	copy(cpy, data)
+
+	switch t {
+	case constants.TYPE_NS, constants.TYPE_CNAME, constants.TYPE_PTR, constants.TYPE_DNAME:
+		lowerName(cpy, 0)
+	case constants.TYPE_MX:
+		lowerName(cpy, 2)
+	case constants.TYPE_SRV:
+		lowerName(cpy, 6)
+	case constants.TYPE_SOA:
+		lowerName(cpy, lowerName(cpy, 0))
+	}
+	return cpy
+}
+
+// lowerName converts the uncompressed name starting at
+// buf[pos] to lowercase and returns the position after it
+func lowerName(buf []byte, pos int) int {
+	for pos < len(buf) {
+		llen := int(buf[pos])
+		if llen == 0 || llen&0xC0 != 0 {
+			return pos + 1
+		}
+		for i := pos + 1; i <= pos+llen && i < len(buf); i++ {
+			if buf[i] >= 'A' && buf[i] <= 'Z' {
+				buf[i] += 'a' - 'A'
+			}
+		}
+		pos += llen + 1
+	}
+	return pos
+}
+
+// verifySignature checks sig over data using the DNSKEY public key material
+func verifySignature(alg uint8, pubkey []byte, data []byte, sig []byte) error {
+	switch alg {
+	case ALG_RSASHA1, ALG_RSASHA1_NSEC3:
+		return verifyRsa(crypto.SHA1, pubkey, data, sig)
+	case ALG_RSASHA256:
+		return verifyRsa(crypto.SHA256, pubkey, data, sig)
+	case ALG_RSASHA512:
+		return verifyRsa(crypto.SHA512, pubkey, data, sig)
+	case ALG_ECDSAP256SHA256:
+		return verifyEcdsa(elliptic.P256(), crypto.SHA256, pubkey, data, sig)
+	case ALG_ECDSAP384SHA384:
+		return verifyEcdsa(elliptic.P384(), crypto.SHA384, pubkey, data, sig)
+	case ALG_ED25519:
+		if len(pubkey) != ed25519.PublicKeySize {
+			return fmt.Errorf("Invalid ED25519 key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(pubkey), data, sig) {
+			return fmt.Errorf("ED25519 signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported algorithm %d", alg)
+}
+
+// verifyRsa checks a RSA signature, the key format is described in RFC 3110 2
+func verifyRsa(h crypto.Hash, pubkey []byte, data []byte, sig []byte) error {
+	if len(pubkey) < 3 {
+		return fmt.Errorf("Short RSA key")
+	}
+	elen := int(pubkey[0])
+	c := 1
+	if elen == 0 {
+		elen = int(binary.BigEndian.Uint16(pubkey[1:]))
+		c = 3
+	}
+	if elen == 0 || elen > 4 || c+elen >= len(pubkey) {
+		return fmt.Errorf("Unsupported RSA exponent")
+	}
+
+	e := 0
+	for _, b := range pubkey[c : c+elen] {
+		e = e<<8 | int(b)
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(pubkey[c+elen:]), E: e}
+
+	hh := h.New()
+	hh.Write(data)
+	return rsa.VerifyPKCS1v15(key, h, hh.Sum(nil), sig)
+}
+
+// verifyEcdsa checks an ECDSA signature as described in RFC 6605 4
+func verifyEcdsa(curve elliptic.Curve, h crypto.Hash, pubkey []byte, data []byte, sig []byte) error {
+	size := curve.Params().BitSize / 8
+	if len(pubkey) != 2*size || len(sig) != 2*size {
+		return fmt.Errorf("Invalid ECDSA key or signature size")
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(pubkey[:size]), Y: new(big.Int).SetBytes(pubkey[size:])}
+
+	hh := h.New()
+	hh.Write(data)
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	if !ecdsa.Verify(key, hh.Sum(nil), r, s) {
+		return fmt.Errorf("ECDSA signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package hints
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"io"
+	"net"
+	"strings"
+)
+
+// Built-in copy of the root hints as published on
+// https://www.internic.net/domain/named.root
+const defaultHints = `
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+B.ROOT-SERVERS.NET.      3600000      AAAA  2801:1b8:10::b
+.                        3600000      NS    C.ROOT-SERVERS.NET.
+C.ROOT-SERVERS.NET.      3600000      A     192.33.4.12
+C.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2::c
+.                        3600000      NS    D.ROOT-SERVERS.NET.
+D.ROOT-SERVERS.NET.      3600000      A     199.7.91.13
+D.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2d::d
+.                        3600000      NS    E.ROOT-SERVERS.NET.
+E.ROOT-SERVERS.NET.      3600000      A     192.203.230.10
+E.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:a8::e
+.                        3600000      NS    F.ROOT-SERVERS.NET.
+F.ROOT-SERVERS.NET.      3600000      A     192.5.5.241
+F.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2f::f
+.                        3600000      NS    G.ROOT-SERVERS.NET.
+G.ROOT-SERVERS.NET.      3600000      A     192.112.36.4
+G.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:12::d0d
+.                        3600000      NS    H.ROOT-SERVERS.NET.
+H.ROOT-SERVERS.NET.      3600000      A     198.97.190.53
+H.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:1::53
+.                        3600000      NS    I.ROOT-SERVERS.NET.
+I.ROOT-SERVERS.NET.      3600000      A     192.36.148.17
+I.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fe::53
+.                        3600000      NS    J.ROOT-SERVERS.NET.
+J.ROOT-SERVERS.NET.      3600000      A     192.58.128.30
+J.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:c27::2:30
+.                        3600000      NS    K.ROOT-SERVERS.NET.
+K.ROOT-SERVERS.NET.      3600000      A     193.0.14.129
+K.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fd::1
+.                        3600000      NS    L.ROOT-SERVERS.NET.
+L.ROOT-SERVERS.NET.      3600000      A     199.7.83.42
+L.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:9f::42
+.                        3600000      NS    M.ROOT-SERVERS.NET.
+M.ROOT-SERVERS.NET.      3600000      A     202.12.27.33
+M.ROOT-SERVERS.NET.      3600000      AAAA  2001:dc3::35
+`
+
+// Default returns the built-in root hints
+func Default() []packet.ResourceRecordFormat {
+	rrs, err := Parse(strings.NewReader(defaultHints))
+	if err != nil {
+		panic(err)
+	}
+	return rrs
+}
+
+// Parse reads root hints in master file format, as used by named.root.
+// Records without a TTL get a TTL of 0. Only NS, A and AAAA records are supported.
+func Parse(r io.Reader) ([]packet.ResourceRecordFormat, error) {
+	root, _ := packet.ParseTextName(".")
+	zp := packet.NewZoneParser(root)
+	zp.SetDefaultTtl(0)
+	rrs, err := zp.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range rrs {
+		if rr.Type != constants.TYPE_NS && rr.Type != constants.TYPE_A && rr.Type != constants.TYPE_AAAA {
+			return nil, fmt.Errorf("Unsupported type %d for %v", rr.Type, &rr.Name)
+		}
+	}
+	if len(Addresses(rrs)) == 0 {
+		return nil, fmt.Errorf("No root server addresses found")
+	}
+	return rrs, nil
+}
+
+// Addresses returns all IPs found in the A and AAAA records of rrs
+func Addresses(rrs []packet.ResourceRecordFormat) []net.IP {
+	ips := make([]net.IP, 0)
+	for _, rr := range rrs {
+		if rr.Type == constants.TYPE_A || rr.Type == constants.TYPE_AAAA {
+			ips = append(ips, net.IP(rr.Data))
+		}
+	}
+	return ips
+}
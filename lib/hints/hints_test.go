@@ -0,0 +1,38 @@
+package hints
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"strings"
+	"testing"
+)
+
+func TestDefaultHints(t *testing.T) {
+	rrs := Default()
+	ns := 0
+	for _, rr := range rrs {
+		if rr.Type == constants.TYPE_NS {
+			ns++
+		}
+	}
+	if ns != 13 || len(Addresses(rrs)) != 26 {
+		panic(fmt.Errorf("Expected 13 NS and 26 addresses, got %d and %d", ns, len(Addresses(rrs))))
+	}
+}
+
+func TestParseHints(t *testing.T) {
+	input := "; a comment\n.  NS  x.example.\nx.example.  IN  A  192.0.2.1 ; trailing\n"
+	rrs, err := Parse(strings.NewReader(input))
+	if err != nil {
+		panic(err)
+	}
+	if len(rrs) != 2 || rrs[1].Ttl != 0 || Addresses(rrs)[0].String() != "192.0.2.1" {
+		panic(fmt.Errorf("Unexpected records: %+v", rrs))
+	}
+
+	for _, bad := range []string{". NS\n", "x. A 2001:db8::1\n", "x. AAAA 192.0.2.1\n", "x. MX 10 mx.\n", ". NS x.\n"} {
+		if _, err := Parse(strings.NewReader(bad)); err == nil {
+			panic(fmt.Errorf("Expected %q to fail", bad))
+		}
+	}
+}
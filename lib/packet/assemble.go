@@ -4,36 +4,94 @@ import (
 	"github.com/adrian-bl/rna/lib/constants"
 )
 
-// Assemble returns binary payload for a ParsedPacket
+// Assemble returns binary payload for a ParsedPacket.
+// Names are compressed as described in RFC 1035 4.1.4
 func Assemble(p *ParsedPacket) []byte {
-	buf := make([]byte, 0)
+	buf := make([]byte, constants.FIX_SIZE_HEADER) // header is filled in once we know the counts
+	cp := &compressor{offsets: make(map[string]int)}
 
 	for _, q := range p.Questions {
-		buf = append(buf, assembleQuestion(q)...)
+		buf = cp.appendQuestion(buf, q)
 	}
 	p.Header.QuestionCount = uint16(len(p.Questions))
 
 	for _, rr := range p.Answers {
-		buf = append(buf, assembleResourceRecord(rr)...)
+		buf = cp.appendResourceRecord(buf, rr)
 	}
 	p.Header.AnswerCount = uint16(len(p.Answers))
 
 	for _, rr := range p.Nameservers {
-		buf = append(buf, assembleResourceRecord(rr)...)
+		buf = cp.appendResourceRecord(buf, rr)
 	}
 	p.Header.NameserverCount = uint16(len(p.Nameservers))
 
 	for _, rr := range p.Additionals {
-		buf = append(buf, assembleResourceRecord(rr)...)
+		buf = cp.appendResourceRecord(buf, rr)
 	}
 	p.Header.AdditionalCount = uint16(len(p.Additionals))
 
-	payload := assembleHeader(p.Header)
-	payload = append(payload, buf...)
+	// The OPT pseudo-RR is not part of Additionals but
+	// is counted in the on-wire header
+	h := p.Header
+	if p.Edns != nil {
+		buf = cp.appendResourceRecord(buf, assembleEdns(p.Edns))
+		h.AdditionalCount++
+	}
+
+	copy(buf, assembleHeader(h))
+	return buf
+}
+
+// AssembleLimited returns binary payload for a ParsedPacket which does
+// not exceed max bytes. Whole RRsets are removed from the additional
+// and authority sections (in this order) until the payload fits.
+// SOA records are kept, as clients need them to cache negative
+// answers (RFC 2308 5). If the payload is still too large, the answer
+// and authority sections are dropped and the TC bit is set (RFC 2181 9).
+// Note that this modifies the sections and header of p.
+func AssembleLimited(p *ParsedPacket, max int) []byte {
+	payload := Assemble(p)
+
+	for len(payload) > max {
+		var dropped bool
+		if p.Additionals, dropped = dropLastRRset(p.Additionals); !dropped {
+			if p.Nameservers, dropped = dropLastRRset(p.Nameservers); !dropped {
+				break
+			}
+		}
+		payload = Assemble(p)
+	}
 
+	if len(payload) > max {
+		p.Header.Truncated = true
+		p.Answers = nil
+		p.Nameservers = nil
+		payload = Assemble(p)
+	}
 	return payload
 }
 
+// dropLastRRset removes all records sharing name, class and type of the
+// last record in rrs which is not a SOA. Returns false if there is none.
+func dropLastRRset(rrs []ResourceRecordFormat) ([]ResourceRecordFormat, bool) {
+	for i := len(rrs) - 1; i >= 0; i-- {
+		last := rrs[i]
+		if last.Type == constants.TYPE_SOA {
+			continue
+		}
+
+		key := last.Name.ToKey()
+		result := make([]ResourceRecordFormat, 0, len(rrs))
+		for _, rr := range rrs {
+			if rr.Type != last.Type || rr.Class != last.Class || rr.Name.ToKey() != key {
+				result = append(result, rr)
+			}
+		}
+		return result, true
+	}
+	return rrs, false
+}
+
 // Returns on-wire representation of an uint32
 func getU32Int(v uint32) []byte {
 	b := make([]byte, 4)
@@ -62,29 +120,89 @@ func setFlag(b *byte, condition bool, val byte) {
 	}
 }
 
-// assembleQuestion transformas a QuestionFormat struct into
-// the on-wire format
-func assembleQuestion(q QuestionFormat) []byte {
-	buf := make([]byte, 0)
-	buf = append(buf, EncodeName(q.Name)...)
+// A compressor remembers the offsets of all names written to
+// a message, so later occurrences can be replaced by pointers
+type compressor struct {
+	offsets map[string]int // case sensitive name key -> offset in message
+}
+
+// appendQuestion appends the on-wire format of q to the message buf
+func (cp *compressor) appendQuestion(buf []byte, q QuestionFormat) []byte {
+	buf = cp.appendName(buf, q.Name)
 	buf = append(buf, getU16Int(q.Type)...)
 	buf = append(buf, getU16Int(q.Class)...)
 	return buf
 }
 
-// assembleResourceRecord transforms a ResourceRecordFormat struct
-// into the on-wire format
-func assembleResourceRecord(rr ResourceRecordFormat) []byte {
-	buf := make([]byte, 0)
-	buf = append(buf, EncodeName(rr.Name)...)
+// appendResourceRecord appends the on-wire format of rr to the message buf
+func (cp *compressor) appendResourceRecord(buf []byte, rr ResourceRecordFormat) []byte {
+	buf = cp.appendName(buf, rr.Name)
 	buf = append(buf, getU16Int(rr.Type)...)
 	buf = append(buf, getU16Int(rr.Class)...)
 	buf = append(buf, getU32Int(rr.Ttl)...)
-	buf = append(buf, getU16Int(uint16(len(rr.Data)))...)
-	buf = append(buf, rr.Data...)
+
+	rdlenPos := len(buf)
+	buf = append(buf, 0, 0) // rdlength, set below
+	buf = cp.appendRdata(buf, rr)
+	setU16Int(buf[rdlenPos:], uint16(len(buf)-rdlenPos-2))
+	return buf
+}
+
+// appendRdata appends the RDATA of rr to the message buf. Only names of the
+// well-known types of RFC 1035 may be compressed (RFC 3597 4)
+func (cp *compressor) appendRdata(buf []byte, rr ResourceRecordFormat) []byte {
+	switch rr.Type {
+	case constants.TYPE_NS, constants.TYPE_CNAME, constants.TYPE_PTR, constants.TYPE_MX, constants.TYPE_SOA:
+	default:
+		return append(buf, rr.Data...)
+	}
+
+	rdata, err := ParseRdata(rr.Type, rr.Data)
+	if err != nil {
+		return append(buf, rr.Data...) // not ours to fix: copy as-is
+	}
+
+	switch rd := rdata.(type) {
+	case *RdataNs:
+		buf = cp.appendName(buf, rd.Name)
+	case *RdataCname:
+		buf = cp.appendName(buf, rd.Name)
+	case *RdataPtr:
+		buf = cp.appendName(buf, rd.Name)
+	case *RdataMx:
+		buf = append(buf, getU16Int(rd.Preference)...)
+		buf = cp.appendName(buf, rd.Exchange)
+	case *RdataSoa:
+		buf = cp.appendName(buf, rd.Mname)
+		buf = cp.appendName(buf, rd.Rname)
+		for _, v := range []uint32{rd.Serial, rd.Refresh, rd.Retry, rd.Expire, rd.Minimum} {
+			buf = append(buf, getU32Int(v)...)
+		}
+	}
 	return buf
 }
 
+// appendName appends n to the message buf, replacing the longest
+// suffix which was already written by a pointer.
+// Suffixes are compared case sensitively to keep the case of all names intact.
+func (cp *compressor) appendName(buf []byte, n Namelabel) []byte {
+	for i, label := range n.name {
+		if label == "" {
+			break
+		}
+		key := n.PoppedLabel(i).ToCaseSensitiveKey()
+		if offset, ok := cp.offsets[key]; ok {
+			return append(buf, getU16Int(0xC000|uint16(offset))...)
+		}
+		if len(buf) <= 0x3FFF { // pointers only have 14 bits
+			cp.offsets[key] = len(buf)
+		}
+		buf = append(buf, uint8(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
 // assembleHeader returns the on-wire format
 // of given ParsedPacketHeader
 func assembleHeader(h ParsedPacketHeader) []byte {
@@ -100,6 +218,8 @@ func assembleHeader(h ParsedPacketHeader) []byte {
 	setFlag(&buf[2], h.RecDesired, 1<<0)
 
 	setFlag(&buf[3], h.RecAvailable, 1<<7)
+	setFlag(&buf[3], h.AuthenticData, 1<<5)
+	setFlag(&buf[3], h.CheckingDisabled, 1<<4)
 	buf[3] |= (h.ResponseCode) & 0xF
 
 	// and append information about how many items to expect in the 'body'
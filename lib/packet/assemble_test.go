@@ -1,6 +1,8 @@
 package packet
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -23,3 +25,127 @@ func TestRFC2181Sect52(t *testing.T) {
 		t.Log("RRSet with different TTLs are forbidden - ignored for now")
 	}
 }
+
+func limitTestPacket() *ParsedPacket {
+	root, _ := ParseName([]byte{0})
+	name, _ := ParseName([]byte{3, 'f', 'o', 'o', 0})
+	other, _ := ParseName([]byte{3, 'b', 'a', 'r', 0})
+
+	pp := &ParsedPacket{}
+	pp.Questions = append(pp.Questions, QuestionFormat{Name: name, Type: 1, Class: 1})
+	pp.Answers = append(pp.Answers, ResourceRecordFormat{Name: name, Type: 1, Class: 1, Data: make([]byte, 4)})
+	pp.Nameservers = append(pp.Nameservers, ResourceRecordFormat{Name: root, Type: 16, Class: 1, Data: make([]byte, 100)})
+	pp.Additionals = append(pp.Additionals, ResourceRecordFormat{Name: name, Type: 28, Class: 1, Data: make([]byte, 16)})
+	pp.Additionals = append(pp.Additionals, ResourceRecordFormat{Name: other, Type: 1, Class: 1, Data: make([]byte, 4)})
+	pp.Additionals = append(pp.Additionals, ResourceRecordFormat{Name: other, Type: 1, Class: 1, Data: make([]byte, 4)})
+	pp.Edns = &EdnsOpt{UdpSize: 512}
+	return pp
+}
+
+func TestAssembleLimitedFits(t *testing.T) {
+	pp := limitTestPacket()
+	full := len(Assemble(pp))
+
+	raw := AssembleLimited(pp, full)
+	if len(raw) != full || pp.Header.Truncated || len(pp.Additionals) != 3 {
+		panic(fmt.Errorf("Packet should have been left untouched"))
+	}
+}
+
+func TestAssembleLimitedDropsAdditionals(t *testing.T) {
+	pp := limitTestPacket()
+	full := len(Assemble(pp))
+
+	// the two A records of 'bar' form one RRset and must be dropped together
+	raw := AssembleLimited(pp, full-1)
+	parsed, err := Parse(raw)
+	if err != nil {
+		panic(err)
+	}
+	if parsed.Header.Truncated || len(parsed.Additionals) != 1 || parsed.Additionals[0].Type != 28 {
+		panic(fmt.Errorf("Expected only the AAAA additional, got %+v", parsed.Additionals))
+	}
+	if len(parsed.Nameservers) != 1 || len(parsed.Answers) != 1 || parsed.Edns == nil {
+		panic(fmt.Errorf("Answer and authority sections should have been kept"))
+	}
+}
+
+func TestAssembleLimitedTruncates(t *testing.T) {
+	pp := limitTestPacket()
+
+	raw := AssembleLimited(pp, 40)
+	if len(raw) > 40 {
+		panic(fmt.Errorf("Payload of %d bytes exceeds the limit", len(raw)))
+	}
+	parsed, err := Parse(raw)
+	if err != nil {
+		panic(err)
+	}
+	if !parsed.Header.Truncated || len(parsed.Answers) != 0 || len(parsed.Questions) != 1 || parsed.Edns == nil {
+		panic(fmt.Errorf("Expected a truncated reply with question and OPT: %+v", parsed))
+	}
+}
+
+func TestAssembleLimitedKeepsSoa(t *testing.T) {
+	root, _ := ParseName([]byte{0})
+	name, _ := ParseName([]byte{3, 'f', 'o', 'o', 0})
+
+	// a negative answer: the NSEC may be dropped, the SOA must stay
+	pp := &ParsedPacket{}
+	pp.Header.ResponseCode = 3
+	pp.Questions = append(pp.Questions, QuestionFormat{Name: name, Type: 1, Class: 1})
+	pp.Nameservers = append(pp.Nameservers, ResourceRecordFormat{Name: root, Type: 6, Class: 1, Data: make([]byte, 22)})
+	pp.Nameservers = append(pp.Nameservers, ResourceRecordFormat{Name: root, Type: 47, Class: 1, Data: make([]byte, 100)})
+	full := len(Assemble(pp))
+
+	parsed, err := Parse(AssembleLimited(pp, full-1))
+	if err != nil {
+		panic(err)
+	}
+	if parsed.Header.Truncated || len(parsed.Nameservers) != 1 || parsed.Nameservers[0].Type != 6 {
+		panic(fmt.Errorf("Expected to keep only the SOA, got %+v", parsed.Nameservers))
+	}
+
+	// if even the SOA does not fit, the client has to retry using TCP
+	parsed, err = Parse(AssembleLimited(pp, 40))
+	if err != nil {
+		panic(err)
+	}
+	if !parsed.Header.Truncated || len(parsed.Nameservers) != 0 {
+		panic(fmt.Errorf("Expected a truncated reply without authority section: %+v", parsed))
+	}
+}
+
+func TestAssembleCompression(t *testing.T) {
+	name, _ := ParseTextName("www.Example.com")
+	zone, _ := ParseTextName("Example.com")
+	mx := &RdataMx{Preference: 10, Exchange: name}
+	srv := &RdataSrv{Port: 443, Target: name}
+
+	pp := &ParsedPacket{}
+	pp.Questions = append(pp.Questions, QuestionFormat{Name: name, Type: 1, Class: 1})
+	pp.Answers = append(pp.Answers, ResourceRecordFormat{Name: name, Type: 1, Class: 1, Data: []byte{192, 0, 2, 1}})
+	pp.Nameservers = append(pp.Nameservers, ResourceRecordFormat{Name: zone, Type: 15, Class: 1, Data: mx.Assemble()})
+	pp.Additionals = append(pp.Additionals, ResourceRecordFormat{Name: zone, Type: 33, Class: 1, Data: srv.Assemble()})
+
+	raw := Assemble(pp)
+	// question name at 12, the answer owner must point to it
+	if raw[12+17+4] != 0xC0 || raw[12+17+5] != 12 {
+		panic(fmt.Errorf("Answer owner was not compressed: %x", raw))
+	}
+
+	parsed, err := Parse(raw)
+	if err != nil {
+		panic(err)
+	}
+	if parsed.Answers[0].Name.ToCaseSensitiveKey() != name.ToCaseSensitiveKey() {
+		panic(fmt.Errorf("Case of the owner name was not kept: %v", parsed.Answers[0].Name))
+	}
+	if string(parsed.Nameservers[0].Data) != string(mx.Assemble()) {
+		panic(fmt.Errorf("MX exchange was not restored"))
+	}
+	// SRV targets must not be compressed (RFC 2782)
+	if !strings.Contains(string(raw), string(srv.Assemble())) {
+		panic(fmt.Errorf("Unexpected payload: %x", raw))
+	}
+}
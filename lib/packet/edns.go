@@ -0,0 +1,68 @@
+package packet
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+)
+
+// EDNS(0) information as carried by the OPT pseudo-RR (RFC 6891 6.1)
+type EdnsOpt struct {
+	UdpSize  uint16       // the max UDP payload size the sender is able to receive
+	ExtRcode uint8        // upper 8 bits of the extended 12 bit rcode
+	Version  uint8        // EDNS version, only 0 is defined
+	DnssecOk bool         // `true' if the sender is able to handle DNSSEC RRs (DO bit, RFC 3225)
+	Options  []EdnsOption // all options found in the RDATA
+}
+
+// A single {attribute, value} pair of the OPT RDATA
+type EdnsOption struct {
+	Code uint16
+	Data []byte
+}
+
+// parseEdns converts an OPT pseudo-RR into its typed representation
+func parseEdns(rr ResourceRecordFormat) (*EdnsOpt, error) {
+	if rr.Name.Len() != 1 || rr.Name.name[0] != "" {
+		return nil, fmt.Errorf("OPT record not owned by root")
+	}
+
+	e := &EdnsOpt{}
+	e.UdpSize = rr.Class
+	e.ExtRcode = uint8(rr.Ttl >> 24)
+	e.Version = uint8(rr.Ttl >> 16)
+	e.DnssecOk = (rr.Ttl&(1<<15) != 0)
+
+	for c := 0; c < len(rr.Data); {
+		if c+4 > len(rr.Data) {
+			return nil, fmt.Errorf("Short EDNS option at %d", c)
+		}
+		code := nUint16(rr.Data[c:])
+		olen := int(nUint16(rr.Data[c+2:]))
+		c += 4
+		if c+olen > len(rr.Data) {
+			return nil, fmt.Errorf("Invalid EDNS option length %d", olen)
+		}
+		data := make([]byte, olen)
+		copy(data, rr.Data[c:c+olen])
+		e.Options = append(e.Options, EdnsOption{Code: code, Data: data})
+		c += olen
+	}
+	return e, nil
+}
+
+// assembleEdns returns the OPT pseudo-RR describing e
+func assembleEdns(e *EdnsOpt) ResourceRecordFormat {
+	rr := ResourceRecordFormat{Name: Namelabel{[]string{""}}, Type: constants.TYPE_OPT, Class: e.UdpSize}
+	rr.Ttl = uint32(e.ExtRcode)<<24 | uint32(e.Version)<<16
+	if e.DnssecOk {
+		rr.Ttl |= 1 << 15
+	}
+
+	rr.Data = make([]byte, 0)
+	for _, o := range e.Options {
+		rr.Data = append(rr.Data, getU16Int(o.Code)...)
+		rr.Data = append(rr.Data, getU16Int(uint16(len(o.Data)))...)
+		rr.Data = append(rr.Data, o.Data...)
+	}
+	return rr
+}
@@ -0,0 +1,62 @@
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestEdnsRoundtrip(t *testing.T) {
+	label, _ := ParseName([]byte{0})
+	pp := &ParsedPacket{}
+	pp.Questions = append(pp.Questions, QuestionFormat{Name: label, Type: 2, Class: 1})
+	pp.Additionals = append(pp.Additionals, ResourceRecordFormat{Name: label, Type: 1, Class: 1, Data: []byte{1, 2, 3, 4}})
+	pp.Edns = &EdnsOpt{UdpSize: 1232, ExtRcode: 1, DnssecOk: true, Options: []EdnsOption{{Code: 10, Data: []byte{0xAA, 0xBB}}}}
+
+	raw := Assemble(pp)
+	if raw[11] != 2 {
+		panic(fmt.Errorf("Expected 2 records in the additional section on the wire, got %d", raw[11]))
+	}
+
+	parsed, err := Parse(raw)
+	if err != nil {
+		panic(err)
+	}
+	if len(parsed.Additionals) != 1 || parsed.Header.AdditionalCount != 1 {
+		panic(fmt.Errorf("OPT record leaked into additionals: %+v", parsed.Additionals))
+	}
+
+	e := parsed.Edns
+	if e == nil {
+		panic(fmt.Errorf("No EDNS data parsed"))
+	}
+	if e.UdpSize != 1232 || e.ExtRcode != 1 || e.Version != 0 || e.DnssecOk != true {
+		panic(fmt.Errorf("Unexpected EDNS header: %+v", e))
+	}
+	if len(e.Options) != 1 || e.Options[0].Code != 10 || !bytes.Equal(e.Options[0].Data, []byte{0xAA, 0xBB}) {
+		panic(fmt.Errorf("Unexpected EDNS options: %+v", e.Options))
+	}
+}
+
+// RFC 6891 6.1.1: only one OPT RR is permitted
+func TestEdnsDuplicate(t *testing.T) {
+	buf := []byte{
+		0x01, 0x64, 0x01, 0x20, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if _, err := Parse(buf); err == nil {
+		panic(fmt.Errorf("Expected an error on duplicate OPT records"))
+	}
+}
+
+func TestEdnsShortOption(t *testing.T) {
+	buf := []byte{
+		0x01, 0x64, 0x01, 0x20, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05,
+		0x00, 0x0a, 0x00, 0x08, 0x01}
+	if _, err := Parse(buf); err == nil {
+		panic(fmt.Errorf("Expected an error on truncated EDNS option"))
+	}
+}
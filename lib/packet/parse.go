@@ -25,6 +25,8 @@ func Parse(buf []byte) (p *ParsedPacket, perr error) {
 	h.Truncated = (buf[2]&(1<<1) != 0)
 	h.RecDesired = (buf[2]&(1<<0) != 0)
 	h.RecAvailable = (buf[3]&(1<<7) != 0)
+	h.AuthenticData = (buf[3]&(1<<5) != 0)
+	h.CheckingDisabled = (buf[3]&(1<<4) != 0)
 	h.ResponseCode = uint8(buf[3]) & 0x0F
 	h.QuestionCount = nUint16(buf[4:])
 	h.AnswerCount = nUint16(buf[6:])
@@ -70,7 +72,13 @@ func Parse(buf []byte) (p *ParsedPacket, perr error) {
 	for i := uint16(0); i < h.AdditionalCount && perr == nil; i++ {
 		var rr ResourceRecordFormat
 		rr, c, perr = parseResourceRecord(buf, c)
-		if perr == nil {
+		if perr == nil && rr.Type == constants.TYPE_OPT {
+			if p.Edns != nil {
+				perr = fmt.Errorf("Duplicate OPT record")
+			} else {
+				p.Edns, perr = parseEdns(rr)
+			}
+		} else if perr == nil {
 			p.Additionals = append(p.Additionals, rr)
 		}
 	}
@@ -125,29 +133,12 @@ func parseResourceRecord(buf []byte, spos int) (rr ResourceRecordFormat, c int,
 		rr.Type = qf.Type
 		rr.Class = qf.Class
 		rr.Ttl = q_ttl
-		label := Namelabel{}
 		if c+q_rdlen <= len(buf) { // fixme!
-			switch rr.Type {
-			case constants.TYPE_NS:
-				fallthrough
-			case constants.TYPE_CNAME:
-				// This might be compressed: we uncompress this label
-				label, _, err = parseName(buf, c)
-				if err == nil {
-					rr.Data = EncodeName(label)
-				}
-			case constants.TYPE_MX:
-				if len(buf) > c+2 { // enough data for <uint16><char>
-					label, _, err = parseName(buf, c+2)
-					if err == nil {
-						// copy MX priority and add expanded label:
-						rr.Data = append([]byte{buf[c], buf[c+1]}, EncodeName(label)...)
-					}
-				} else {
-					err = fmt.Errorf("Invalid MX record")
-				}
-			default:
-				rr.Data = buf[c:(c + q_rdlen)]
+			// Parse the typed RDATA: this expands all (possibly compressed) names
+			var rdata Rdata
+			rdata, err = parseRdata(buf, c, q_rdlen, rr.Type)
+			if err == nil {
+				rr.Data = rdata.Assemble()
 			}
 			c += q_rdlen
 		} else {
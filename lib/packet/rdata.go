@@ -0,0 +1,477 @@
+package packet
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rdata is the typed representation of the RDATA of a resource record
+type Rdata interface {
+	Assemble() []byte // returns the uncompressed on-wire format
+	String() string   // returns the presentation format (RFC 1035 5.1)
+}
+
+// Address of an A record
+type RdataA struct {
+	Addr net.IP
+}
+
+// Address of an AAAA record (RFC 3596)
+type RdataAaaa struct {
+	Addr net.IP
+}
+
+// Target of an NS record
+type RdataNs struct {
+	Name Namelabel
+}
+
+// Target of a CNAME record
+type RdataCname struct {
+	Name Namelabel
+}
+
+// Target of a PTR record
+type RdataPtr struct {
+	Name Namelabel
+}
+
+// Target of a DNAME record (RFC 6672)
+type RdataDname struct {
+	Name Namelabel
+}
+
+// Start of authority
+type RdataSoa struct {
+	Mname   Namelabel
+	Rname   Namelabel
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32 // TTL of negative replies (RFC 2308)
+}
+
+// Mail exchanger
+type RdataMx struct {
+	Preference uint16
+	Exchange   Namelabel
+}
+
+// Text record, holding one or more character-strings
+type RdataTxt struct {
+	Strings []string
+}
+
+// Service location (RFC 2782)
+type RdataSrv struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   Namelabel
+}
+
+// Naming authority pointer (RFC 3403)
+type RdataNaptr struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Services    string
+	Regexp      string
+	Replacement Namelabel
+}
+
+// Certification authority authorization (RFC 8659)
+type RdataCaa struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+// Service binding, used by SVCB and HTTPS records (RFC 9460)
+type RdataSvcb struct {
+	Priority uint16 // 0 for alias mode
+	Target   Namelabel
+	Params   []SvcParam
+}
+
+// A single SvcParam of a SVCB record
+type SvcParam struct {
+	Key   uint16
+	Value []byte
+}
+
+// RDATA of a type we do not know about (RFC 3597)
+type RdataUnknown struct {
+	Data []byte
+}
+
+// Keys of SvcParams (RFC 9460 14.3.2)
+var svcParamKeys = []string{"mandatory", "alpn", "no-default-alpn", "port", "ipv4hint", "ech", "ipv6hint"}
+
+// ParseRdata converts the uncompressed RDATA of a record with type t into its typed representation
+func ParseRdata(t uint16, data []byte) (Rdata, error) {
+	return parseRdata(data, 0, len(data), t)
+}
+
+// parseRdata parses rdlen bytes of RDATA starting at spos in the message buf.
+// Names are expanded, so compression pointers may point anywhere before spos.
+func parseRdata(buf []byte, spos int, rdlen int, t uint16) (Rdata, error) {
+	r := &rdataReader{buf: buf, pos: spos, end: spos + rdlen}
+	var rd Rdata
+
+	switch t {
+	case constants.TYPE_A:
+		rd = &RdataA{Addr: net.IP(r.bytes(net.IPv4len))}
+	case constants.TYPE_AAAA:
+		rd = &RdataAaaa{Addr: net.IP(r.bytes(net.IPv6len))}
+	case constants.TYPE_NS:
+		rd = &RdataNs{Name: r.name()}
+	case constants.TYPE_CNAME:
+		rd = &RdataCname{Name: r.name()}
+	case constants.TYPE_PTR:
+		rd = &RdataPtr{Name: r.name()}
+	case constants.TYPE_DNAME:
+		rd = &RdataDname{Name: r.name()}
+	case constants.TYPE_SOA:
+		rd = &RdataSoa{Mname: r.name(), Rname: r.name(), Serial: r.u32(), Refresh: r.u32(), Retry: r.u32(), Expire: r.u32(), Minimum: r.u32()}
+	case constants.TYPE_MX:
+		rd = &RdataMx{Preference: r.u16(), Exchange: r.name()}
+	case constants.TYPE_TXT:
+		txt := &RdataTxt{}
+		for r.pos < r.end && r.err == nil {
+			txt.Strings = append(txt.Strings, r.charString())
+		}
+		if len(txt.Strings) == 0 {
+			r.err = fmt.Errorf("Empty TXT record")
+		}
+		rd = txt
+	case constants.TYPE_SRV:
+		rd = &RdataSrv{Priority: r.u16(), Weight: r.u16(), Port: r.u16(), Target: r.name()}
+	case constants.TYPE_NAPTR:
+		rd = &RdataNaptr{Order: r.u16(), Preference: r.u16(), Flags: r.charString(), Services: r.charString(), Regexp: r.charString(), Replacement: r.name()}
+	case constants.TYPE_CAA:
+		caa := &RdataCaa{Flags: r.u8()}
+		caa.Tag = r.charString()
+		caa.Value = string(r.bytes(r.end - r.pos))
+		rd = caa
+	case constants.TYPE_SVCB, constants.TYPE_HTTPS:
+		svcb := &RdataSvcb{Priority: r.u16(), Target: r.name()}
+		for r.pos < r.end && r.err == nil {
+			key := r.u16()
+			svcb.Params = append(svcb.Params, SvcParam{Key: key, Value: r.bytes(int(r.u16()))})
+		}
+		rd = svcb
+	default:
+		rd = &RdataUnknown{Data: r.bytes(rdlen)}
+	}
+
+	if r.err == nil && r.pos != r.end {
+		r.err = fmt.Errorf("Trailing data in RDATA of type %d", t)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return rd, nil
+}
+
+// rdataReader reads values from RDATA, remembering the first error
+type rdataReader struct {
+	buf []byte // the full message, needed to follow compression pointers
+	pos int
+	end int
+	err error
+}
+
+// bytes returns a copy of the next n bytes
+func (r *rdataReader) bytes(n int) []byte {
+	if r.err == nil && (n < 0 || r.pos+n > r.end || r.end > len(r.buf)) {
+		r.err = fmt.Errorf("Short RDATA")
+	}
+	if r.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.buf[r.pos:])
+	r.pos += n
+	return b
+}
+
+func (r *rdataReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *rdataReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return nUint16(b)
+	}
+	return 0
+}
+
+func (r *rdataReader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return nUint32(b)
+	}
+	return 0
+}
+
+// charString reads a length-prefixed <character-string>
+func (r *rdataReader) charString() string {
+	return string(r.bytes(int(r.u8())))
+}
+
+// name reads a possibly compressed name which must end within the RDATA
+func (r *rdataReader) name() Namelabel {
+	if r.err != nil {
+		return Namelabel{}
+	}
+	n, c, err := parseName(r.buf[:r.end], r.pos)
+	if err != nil {
+		r.err = err
+		return Namelabel{}
+	}
+	r.pos = c
+	return n
+}
+
+func (rd *RdataA) Assemble() []byte {
+	return append([]byte{}, rd.Addr.To4()...)
+}
+
+func (rd *RdataA) String() string {
+	return rd.Addr.String()
+}
+
+func (rd *RdataAaaa) Assemble() []byte {
+	return append([]byte{}, rd.Addr.To16()...)
+}
+
+func (rd *RdataAaaa) String() string {
+	return rd.Addr.String()
+}
+
+func (rd *RdataNs) Assemble() []byte {
+	return EncodeName(rd.Name)
+}
+
+func (rd *RdataNs) String() string {
+	return rd.Name.String()
+}
+
+func (rd *RdataCname) Assemble() []byte {
+	return EncodeName(rd.Name)
+}
+
+func (rd *RdataCname) String() string {
+	return rd.Name.String()
+}
+
+func (rd *RdataPtr) Assemble() []byte {
+	return EncodeName(rd.Name)
+}
+
+func (rd *RdataPtr) String() string {
+	return rd.Name.String()
+}
+
+func (rd *RdataDname) Assemble() []byte {
+	return EncodeName(rd.Name)
+}
+
+func (rd *RdataDname) String() string {
+	return rd.Name.String()
+}
+
+func (rd *RdataSoa) Assemble() []byte {
+	buf := append(EncodeName(rd.Mname), EncodeName(rd.Rname)...)
+	for _, v := range []uint32{rd.Serial, rd.Refresh, rd.Retry, rd.Expire, rd.Minimum} {
+		buf = append(buf, getU32Int(v)...)
+	}
+	return buf
+}
+
+func (rd *RdataSoa) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", rd.Mname.String(), rd.Rname.String(), rd.Serial, rd.Refresh, rd.Retry, rd.Expire, rd.Minimum)
+}
+
+func (rd *RdataMx) Assemble() []byte {
+	return append(getU16Int(rd.Preference), EncodeName(rd.Exchange)...)
+}
+
+func (rd *RdataMx) String() string {
+	return fmt.Sprintf("%d %s", rd.Preference, rd.Exchange.String())
+}
+
+func (rd *RdataTxt) Assemble() []byte {
+	buf := make([]byte, 0)
+	for _, s := range rd.Strings {
+		buf = appendCharString(buf, s)
+	}
+	return buf
+}
+
+func (rd *RdataTxt) String() string {
+	quoted := make([]string, len(rd.Strings))
+	for i, s := range rd.Strings {
+		quoted[i] = quoteCharString(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (rd *RdataSrv) Assemble() []byte {
+	buf := append(getU16Int(rd.Priority), getU16Int(rd.Weight)...)
+	buf = append(buf, getU16Int(rd.Port)...)
+	return append(buf, EncodeName(rd.Target)...)
+}
+
+func (rd *RdataSrv) String() string {
+	return fmt.Sprintf("%d %d %d %s", rd.Priority, rd.Weight, rd.Port, rd.Target.String())
+}
+
+func (rd *RdataNaptr) Assemble() []byte {
+	buf := append(getU16Int(rd.Order), getU16Int(rd.Preference)...)
+	buf = appendCharString(buf, rd.Flags)
+	buf = appendCharString(buf, rd.Services)
+	buf = appendCharString(buf, rd.Regexp)
+	return append(buf, EncodeName(rd.Replacement)...)
+}
+
+func (rd *RdataNaptr) String() string {
+	return fmt.Sprintf("%d %d %s %s %s %s", rd.Order, rd.Preference, quoteCharString(rd.Flags),
+		quoteCharString(rd.Services), quoteCharString(rd.Regexp), rd.Replacement.String())
+}
+
+func (rd *RdataCaa) Assemble() []byte {
+	buf := appendCharString([]byte{rd.Flags}, rd.Tag)
+	return append(buf, rd.Value...)
+}
+
+func (rd *RdataCaa) String() string {
+	return fmt.Sprintf("%d %s %s", rd.Flags, rd.Tag, quoteCharString(rd.Value))
+}
+
+func (rd *RdataSvcb) Assemble() []byte {
+	buf := append(getU16Int(rd.Priority), EncodeName(rd.Target)...)
+	for _, p := range rd.Params {
+		buf = append(buf, getU16Int(p.Key)...)
+		buf = append(buf, getU16Int(uint16(len(p.Value)))...)
+		buf = append(buf, p.Value...)
+	}
+	return buf
+}
+
+func (rd *RdataSvcb) String() string {
+	s := fmt.Sprintf("%d %s", rd.Priority, rd.Target.String())
+	for _, p := range rd.Params {
+		s += " " + p.String()
+	}
+	return s
+}
+
+// String returns the key=value presentation format of p (RFC 9460 2.1)
+func (p *SvcParam) String() string {
+	key := svcParamKeyName(p.Key)
+	value := ""
+	switch p.Key {
+	case 0: // mandatory
+		keys := make([]string, 0)
+		for i := 0; i+1 < len(p.Value); i += 2 {
+			keys = append(keys, svcParamKeyName(nUint16(p.Value[i:])))
+		}
+		value = strings.Join(keys, ",")
+	case 1: // alpn
+		ids := make([]string, 0)
+		for i := 0; i < len(p.Value); i += 1 + int(p.Value[i]) {
+			if i+1+int(p.Value[i]) > len(p.Value) {
+				break
+			}
+			ids = append(ids, string(p.Value[i+1:i+1+int(p.Value[i])]))
+		}
+		value = quoteCharString(strings.Join(ids, ","))
+	case 3: // port
+		if len(p.Value) == 2 {
+			value = strconv.Itoa(int(nUint16(p.Value)))
+		}
+	case 4, 6: // ipv4hint and ipv6hint
+		size := net.IPv4len
+		if p.Key == 6 {
+			size = net.IPv6len
+		}
+		addrs := make([]string, 0)
+		for i := 0; i+size <= len(p.Value); i += size {
+			addrs = append(addrs, net.IP(p.Value[i:i+size]).String())
+		}
+		value = strings.Join(addrs, ",")
+	case 5: // ech
+		value = base64.StdEncoding.EncodeToString(p.Value)
+	default:
+		value = quoteCharString(string(p.Value))
+	}
+
+	if value == "" && len(p.Value) == 0 {
+		return key
+	}
+	return key + "=" + value
+}
+
+// svcParamKeyName returns the presentation format of a SvcParamKey
+func svcParamKeyName(key uint16) string {
+	if int(key) < len(svcParamKeys) {
+		return svcParamKeys[key]
+	}
+	return fmt.Sprintf("key%d", key)
+}
+
+func (rd *RdataUnknown) Assemble() []byte {
+	return append([]byte{}, rd.Data...)
+}
+
+func (rd *RdataUnknown) String() string {
+	if len(rd.Data) == 0 {
+		return "\\# 0"
+	}
+	return fmt.Sprintf("\\# %d %s", len(rd.Data), hex.EncodeToString(rd.Data))
+}
+
+// appendCharString appends s as a length-prefixed <character-string>,
+// truncating it to 255 bytes
+func appendCharString(buf []byte, s string) []byte {
+	if len(s) > 0xFF {
+		s = s[:0xFF]
+	}
+	buf = append(buf, uint8(len(s)))
+	return append(buf, s...)
+}
+
+// quoteCharString returns s as a quoted string, escaping
+// quotes, backslashes and non-printable characters
+func quoteCharString(s string) string {
+	return "\"" + escapeText(s, "\"\\") + "\""
+}
+
+// escapeText escapes all characters of s found in special, along
+// with all non-printable characters (RFC 1035 5.1)
+func escapeText(s string, special string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c < 0x20 || c > 0x7E:
+			fmt.Fprintf(&b, "\\%03d", c)
+		case strings.IndexByte(special, c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
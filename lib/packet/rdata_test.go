@@ -0,0 +1,97 @@
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"testing"
+)
+
+// A reply for example.com/SOA: the SOA names are compressed and point into the question
+func TestRdataSoaDecompressed(t *testing.T) {
+	buf := []byte{
+		0x00, 0x01, 0x84, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00, 0x00, 0x06, 0x00, 0x01,
+		0xc0, 0x0c, 0x00, 0x06, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x21,
+		0x02, 'n', 's', 0xc0, 0x0c, // ns.example.com
+		0x05, 'a', 'd', 'm', 'i', 'n', 0xc0, 0x0c, // admin.example.com
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x03,
+		0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x05,
+	}
+	p, err := Parse(buf)
+	if err != nil {
+		panic(err)
+	}
+
+	rd, err := ParseRdata(constants.TYPE_SOA, p.Answers[0].Data)
+	if err != nil {
+		panic(err)
+	}
+	if s := rd.String(); s != "ns.example.com. admin.example.com. 1 2 3 4 5" {
+		panic(fmt.Errorf("Unexpected SOA: %s", s))
+	}
+	if ParseSoaTtl(p.Answers[0].Data) != 5 {
+		panic(fmt.Errorf("Unexpected SOA TTL"))
+	}
+}
+
+func TestRdataRoundTrip(t *testing.T) {
+	target, _ := ParseTextName("srv.example.com")
+	tests := []struct {
+		t    uint16
+		rd   Rdata
+		text string
+	}{
+		{constants.TYPE_A, &RdataA{Addr: []byte{192, 0, 2, 1}}, "192.0.2.1"},
+		{constants.TYPE_AAAA, &RdataAaaa{Addr: append(make([]byte, 15), 1)}, "::1"},
+		{constants.TYPE_CNAME, &RdataCname{Name: target}, "srv.example.com."},
+		{constants.TYPE_MX, &RdataMx{Preference: 10, Exchange: target}, "10 srv.example.com."},
+		{constants.TYPE_TXT, &RdataTxt{Strings: []string{"v=spf1 -all", "a \"b\"\x01"}}, "\"v=spf1 -all\" \"a \\\"b\\\"\\001\""},
+		{constants.TYPE_SRV, &RdataSrv{Priority: 1, Weight: 2, Port: 443, Target: target}, "1 2 443 srv.example.com."},
+		{constants.TYPE_NAPTR, &RdataNaptr{Order: 100, Preference: 10, Flags: "S", Services: "SIP+D2U", Replacement: target}, "100 10 \"S\" \"SIP+D2U\" \"\" srv.example.com."},
+		{constants.TYPE_CAA, &RdataCaa{Flags: 0, Tag: "issue", Value: "ca.example.net"}, "0 issue \"ca.example.net\""},
+		{constants.TYPE_HTTPS, &RdataSvcb{Priority: 1, Target: Namelabel{[]string{""}}, Params: []SvcParam{
+			{Key: 1, Value: []byte{2, 'h', '2', 2, 'h', '3'}},
+			{Key: 3, Value: []byte{0x01, 0xbb}},
+			{Key: 4, Value: []byte{192, 0, 2, 1}},
+		}}, "1 . alpn=\"h2,h3\" port=443 ipv4hint=192.0.2.1"},
+		{99, &RdataUnknown{Data: []byte{0xde, 0xad}}, "\\# 2 dead"},
+	}
+
+	for _, test := range tests {
+		wire := test.rd.Assemble()
+		rd, err := ParseRdata(test.t, wire)
+		if err != nil {
+			panic(fmt.Errorf("type %d: %v", test.t, err))
+		}
+		if !bytes.Equal(rd.Assemble(), wire) {
+			panic(fmt.Errorf("type %d: round trip changed the wire format", test.t))
+		}
+		if rd.String() != test.text {
+			panic(fmt.Errorf("type %d: expected %s, got %s", test.t, test.text, rd.String()))
+		}
+	}
+}
+
+func TestRdataInvalid(t *testing.T) {
+	if _, err := ParseRdata(constants.TYPE_A, []byte{1, 2, 3}); err == nil {
+		panic(fmt.Errorf("Short A record was accepted"))
+	}
+	if _, err := ParseRdata(constants.TYPE_NS, []byte{0, 0}); err == nil {
+		panic(fmt.Errorf("NS record with trailing data was accepted"))
+	}
+	if _, err := ParseRdata(constants.TYPE_MX, []byte{0, 10, 3, 'f', 'o'}); err == nil {
+		panic(fmt.Errorf("MX with a truncated name was accepted"))
+	}
+}
+
+func TestNameString(t *testing.T) {
+	root := Namelabel{[]string{""}}
+	if root.String() != "." {
+		panic(fmt.Errorf("Unexpected root name: %s", root.String()))
+	}
+	n := Namelabel{[]string{"a.b", "c d", "com", ""}}
+	if n.String() != "a\\.b.c\\ d.com." {
+		panic(fmt.Errorf("Unexpected name: %s", n.String()))
+	}
+}
@@ -1,21 +1,26 @@
 package packet
 
-import "strings"
+import (
+	"crypto/rand"
+	"strings"
+)
 
 // The parsed representation of a DNS header
 type ParsedPacketHeader struct {
-	Id              uint16 // Id of this query
-	Response        bool   // `true' if this is a response (qr)
-	Opcode          uint8  // The RFC1035 opcode of this query (usually OP_QUERY)
-	Authoritative   bool   // `true' if we have authorative data in the reply
-	Truncated       bool   // `true' if the query was truncated and might be re-done using TCP or EDNS
-	RecDesired      bool   // `true' if the client asked us to resolve recursively
-	RecAvailable    bool   // indicates if the host generating this reply is willing to do recursive queries
-	ResponseCode    uint8  // RFC1035 response code, such as NXDOMAIN
-	QuestionCount   uint16 // Number of questions in this packet
-	AnswerCount     uint16 // Number of items in the answer section
-	NameserverCount uint16 // Number of items in the NS section
-	AdditionalCount uint16 // Number of items in the additional section
+	Id               uint16 // Id of this query
+	Response         bool   // `true' if this is a response (qr)
+	Opcode           uint8  // The RFC1035 opcode of this query (usually OP_QUERY)
+	Authoritative    bool   // `true' if we have authorative data in the reply
+	Truncated        bool   // `true' if the query was truncated and might be re-done using TCP or EDNS
+	RecDesired       bool   // `true' if the client asked us to resolve recursively
+	RecAvailable     bool   // indicates if the host generating this reply is willing to do recursive queries
+	AuthenticData    bool   // `true' if all data in the reply was validated using DNSSEC (ad)
+	CheckingDisabled bool   // `true' if the client does not want us to validate DNSSEC data (cd)
+	ResponseCode     uint8  // RFC1035 response code, such as NXDOMAIN
+	QuestionCount    uint16 // Number of questions in this packet
+	AnswerCount      uint16 // Number of items in the answer section
+	NameserverCount  uint16 // Number of items in the NS section
+	AdditionalCount  uint16 // Number of items in the additional section, excluding OPT
 }
 
 // String array typed to describe DNS labels
@@ -65,13 +70,80 @@ func (l *Namelabel) IsChildOf(parent *Namelabel) bool {
 	return true
 }
 
-// Returns a copy of this namelabel but with
-// shuffled cases
+// Compare returns an integer comparing l and o in canonical
+// DNS name order (RFC 4034 6.1): -1 if l < o, 0 if equal, 1 if l > o
+func (l *Namelabel) Compare(o *Namelabel) int {
+	la := l.Len()
+	lb := o.Len()
+	for i := 1; i <= la && i <= lb; i++ {
+		if c := compareLabel(l.name[la-i], o.name[lb-i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case la < lb:
+		return -1
+	case la > lb:
+		return 1
+	}
+	return 0
+}
+
+// compareLabel compares two labels as unsigned octet strings, only
+// folding the case of ASCII letters (RFC 4034 6.1)
+func compareLabel(a string, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lowerAscii(a[i]), lowerAscii(b[i])
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+// lowerAscii returns the lowercase version of c if it is an ASCII letter
+func lowerAscii(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// Returns a copy of this namelabel but with randomly shuffled
+// cases of all letters (draft-vixie-dnsext-dns0x20)
 func (l *Namelabel) ShuffleCases() *Namelabel {
+	size := 0
+	for _, v := range l.name {
+		size += len(v)
+	}
+	bits := make([]byte, size/8+1)
+	if _, err := rand.Read(bits); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+
 	var result []string
+	n := 0
 	for _, v := range l.name {
-		// fixme: use something random, not Title()
-		result = append(result, strings.Title(v))
+		b := []byte(v)
+		for i, c := range b {
+			upper := bits[n/8]&(1<<uint(n%8)) != 0
+			n++
+			if c >= 'a' && c <= 'z' && upper {
+				b[i] = c - 'a' + 'A'
+			} else if c >= 'A' && c <= 'Z' && !upper {
+				b[i] = c - 'A' + 'a'
+			}
+		}
+		result = append(result, string(b))
 	}
 	return &Namelabel{result}
 }
@@ -82,7 +154,8 @@ type ParsedPacket struct {
 	Questions   []QuestionFormat
 	Answers     []ResourceRecordFormat
 	Nameservers []ResourceRecordFormat
-	Additionals []ResourceRecordFormat
+	Additionals []ResourceRecordFormat // does not include the OPT pseudo-RR
+	Edns        *EdnsOpt               // EDNS(0) data, nil if the packet had no OPT RR
 }
 
 // Question section of the DNS packet
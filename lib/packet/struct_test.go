@@ -33,3 +33,61 @@ func TestXH(t *testing.T) {
 		panic(fmt.Errorf("Test should be case INSENSITIVE"))
 	}
 }
+
+// Example of RFC 4034 6.1
+func TestCanonicalOrder(t *testing.T) {
+	ordered := []*Namelabel{
+		{[]string{"example", ""}},
+		{[]string{"a", "example", ""}},
+		{[]string{"yljkjljk", "a", "example", ""}},
+		{[]string{"Z", "a", "example", ""}},
+		{[]string{"zABC", "a", "EXAMPLE", ""}},
+		{[]string{"z", "example", ""}},
+		{[]string{"\001", "z", "example", ""}},
+		{[]string{"*", "z", "example", ""}},
+		{[]string{"\200", "z", "example", ""}},
+	}
+
+	for i := 0; i < len(ordered)-1; i++ {
+		if ordered[i].Compare(ordered[i+1]) != -1 || ordered[i+1].Compare(ordered[i]) != 1 {
+			panic(fmt.Errorf("%v should sort before %v", ordered[i], ordered[i+1]))
+		}
+	}
+	if ordered[3].Compare(&Namelabel{[]string{"z", "A", "example", ""}}) != 0 {
+		panic(fmt.Errorf("Compare should be case insensitive"))
+	}
+}
+
+func TestCompareBinaryLabels(t *testing.T) {
+	// labels are compared octet-wise: bytes >= 0x80 sort after ASCII and are not case folded
+	ordered := []*Namelabel{
+		{[]string{"Z", "example", ""}},
+		{[]string{"\x80", "example", ""}},
+		{[]string{"\x80a", "example", ""}},
+		{[]string{"\xC0", "example", ""}},
+		{[]string{"\xE0", "example", ""}},
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		if ordered[i].Compare(ordered[i+1]) != -1 || ordered[i+1].Compare(ordered[i]) != 1 {
+			panic(fmt.Errorf("%v should sort before %v", ordered[i], ordered[i+1]))
+		}
+	}
+	if ordered[1].Compare(ordered[4]) == 0 {
+		panic(fmt.Errorf("Different binary labels compare as equal"))
+	}
+}
+
+func TestShuffleCases(t *testing.T) {
+	n := &Namelabel{[]string{"www", "example-1", "com", ""}}
+	seen := make(map[string]bool)
+	for i := 0; i < 16; i++ {
+		s := n.ShuffleCases()
+		if s.ToKey() != n.ToKey() {
+			panic(fmt.Errorf("Shuffled name %v differs from %v", s, n))
+		}
+		seen[s.ToCaseSensitiveKey()] = true
+	}
+	if len(seen) < 2 {
+		panic(fmt.Errorf("ShuffleCases does not look random"))
+	}
+}
@@ -0,0 +1,34 @@
+package packet
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"io"
+)
+
+// ReadTcpFrame reads a single length-prefixed DNS message
+// from r, as described in RFC 1035 4.2.2 and RFC 7766 8
+func ReadTcpFrame(r io.Reader) ([]byte, error) {
+	lbuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lbuf); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, nUint16(lbuf))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// WriteTcpFrame writes payload to w, prefixed with its
+// 16 bit length. The message is sent using a single write
+// as some implementations do not cope with split frames.
+func WriteTcpFrame(w io.Writer, payload []byte) error {
+	if len(payload) > constants.MAX_SIZE_TCP {
+		return fmt.Errorf("Payload too large for TCP: %d bytes", len(payload))
+	}
+	buf := append(getU16Int(uint16(len(payload))), payload...)
+	_, err := w.Write(buf)
+	return err
+}
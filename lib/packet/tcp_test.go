@@ -0,0 +1,46 @@
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestTcpFrameRoundtrip(t *testing.T) {
+	var b bytes.Buffer
+	payload := []byte{0x01, 0x02, 0x03}
+
+	if err := WriteTcpFrame(&b, payload); err != nil {
+		panic(err)
+	}
+	if err := WriteTcpFrame(&b, payload[1:]); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(b.Bytes()[0:2], []byte{0x00, 0x03}) {
+		panic(fmt.Errorf("Invalid length prefix: %v", b.Bytes()[0:2]))
+	}
+
+	first, err := ReadTcpFrame(&b)
+	if err != nil || !bytes.Equal(first, payload) {
+		panic(fmt.Errorf("Unexpected first frame: %v, err=%v", first, err))
+	}
+	second, err := ReadTcpFrame(&b)
+	if err != nil || !bytes.Equal(second, payload[1:]) {
+		panic(fmt.Errorf("Unexpected second frame: %v, err=%v", second, err))
+	}
+}
+
+// A frame which announces more data than it carries must fail
+func TestTcpFrameShort(t *testing.T) {
+	b := bytes.NewBuffer([]byte{0x00, 0x05, 0x01, 0x02})
+	if _, err := ReadTcpFrame(b); err == nil {
+		panic(fmt.Errorf("Expected an error on short frame"))
+	}
+}
+
+func TestTcpFrameTooLarge(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteTcpFrame(&b, make([]byte, 0x10000)); err == nil {
+		panic(fmt.Errorf("Expected an error on oversized payload"))
+	}
+}
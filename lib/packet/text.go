@@ -0,0 +1,111 @@
+package packet
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"strconv"
+	"strings"
+)
+
+// ParseTextName converts a name in presentation format (`www.example.com.')
+// into a Namelabel. All names are treated as fully qualified.
+func ParseTextName(s string) (Namelabel, error) {
+	n, _, err := parseTextLabels(s)
+	return n, err
+}
+
+// parseTextLabels converts s into a Namelabel, honoring escapes (RFC 1035 5.1).
+// absolute is set if s ends with an unescaped dot.
+func parseTextLabels(s string) (n Namelabel, absolute bool, err error) {
+	if s == "" || s == "." {
+		return Namelabel{[]string{""}}, true, nil
+	}
+
+	label := make([]byte, 0)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '.':
+			if len(label) == 0 || len(label) > constants.MAX_SIZE_LABEL {
+				return Namelabel{}, false, fmt.Errorf("Invalid label in name %q", s)
+			}
+			n.name = append(n.name, string(label))
+			label = label[:0]
+			absolute = i == len(s)-1
+		case '\\':
+			b, size, err := unescapeAt(s, i)
+			if err != nil {
+				return Namelabel{}, false, err
+			}
+			label = append(label, b)
+			i += size - 1
+		default:
+			label = append(label, c)
+		}
+	}
+	if !absolute {
+		if len(label) > constants.MAX_SIZE_LABEL {
+			return Namelabel{}, false, fmt.Errorf("Invalid label in name %q", s)
+		}
+		n.name = append(n.name, string(label))
+	}
+	n.name = append(n.name, "")
+
+	if len(EncodeName(n)) > constants.MAX_SIZE_NAME {
+		return Namelabel{}, false, fmt.Errorf("Name %q is too long", s)
+	}
+	return n, absolute, nil
+}
+
+// unescapeText removes all escapes (`\X' and `\DDD') from s
+func unescapeText(s string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		c, size, err := unescapeAt(s, i)
+		if err != nil {
+			return "", err
+		}
+		b = append(b, c)
+		i += size - 1
+	}
+	return string(b), nil
+}
+
+// unescapeAt decodes the escape sequence starting at s[i], returning
+// the byte it stands for and the length of the sequence
+func unescapeAt(s string, i int) (byte, int, error) {
+	if i+1 >= len(s) {
+		return 0, 0, fmt.Errorf("Incomplete escape in %q", s)
+	}
+	if s[i+1] < '0' || s[i+1] > '9' {
+		return s[i+1], 2, nil
+	}
+	if i+3 >= len(s) {
+		return 0, 0, fmt.Errorf("Incomplete escape in %q", s)
+	}
+	v, err := strconv.ParseUint(s[i+1:i+4], 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid escape in %q", s)
+	}
+	return byte(v), 4, nil
+}
+
+// String returns the presentation format of l, such as `www.example.com.'
+func (l *Namelabel) String() string {
+	labels := make([]string, 0, len(l.name))
+	for _, label := range l.name {
+		labels = append(labels, escapeText(label, ".\\\"();@$ "))
+	}
+	s := strings.Join(labels, ".")
+	if s == "" {
+		return "."
+	}
+	return s
+}
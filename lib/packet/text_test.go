@@ -0,0 +1,39 @@
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseTextName(t *testing.T) {
+	n, err := ParseTextName("www.Example.com.")
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(EncodeName(n), []byte("\x03www\x07Example\x03com\x00")) {
+		panic(fmt.Errorf("Unexpected encoding: %v", EncodeName(n)))
+	}
+
+	rel, _ := ParseTextName("www.example.com")
+	if rel.ToKey() != n.ToKey() {
+		panic(fmt.Errorf("Trailing dot should be optional"))
+	}
+
+	root, err := ParseTextName(".")
+	if err != nil || root.Len() != 1 {
+		panic(fmt.Errorf("Failed to parse root: %v %v", root, err))
+	}
+
+	esc, err := ParseTextName(`a\.b\065.example.`)
+	if err != nil || esc.Len() != 3 || esc.String() != `a\.bA.example.` {
+		panic(fmt.Errorf("Failed to parse escaped name: %v %v", &esc, err))
+	}
+
+	for _, bad := range []string{"a..b", `a\`, `a\25`, `\256`, strings.Repeat("x", 64) + ".com", strings.Repeat("abcdefg.", 40)} {
+		if _, err := ParseTextName(bad); err == nil {
+			panic(fmt.Errorf("Expected %q to fail", bad))
+		}
+	}
+}
@@ -0,0 +1,686 @@
+package packet
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const MAX_INCLUDE_DEPTH = 8 // max. nesting of $INCLUDE directives
+
+// Mnemonics of all types we can parse from text
+var typeNames = map[string]uint16{
+	"A":      constants.TYPE_A,
+	"NS":     constants.TYPE_NS,
+	"CNAME":  constants.TYPE_CNAME,
+	"SOA":    constants.TYPE_SOA,
+	"PTR":    constants.TYPE_PTR,
+	"MX":     constants.TYPE_MX,
+	"TXT":    constants.TYPE_TXT,
+	"AAAA":   constants.TYPE_AAAA,
+	"SRV":    constants.TYPE_SRV,
+	"NAPTR":  constants.TYPE_NAPTR,
+	"DNAME":  constants.TYPE_DNAME,
+	"DS":     constants.TYPE_DS,
+	"RRSIG":  constants.TYPE_RRSIG,
+	"NSEC":   constants.TYPE_NSEC,
+	"DNSKEY": constants.TYPE_DNSKEY,
+	"NSEC3":  constants.TYPE_NSEC3,
+	"SVCB":   constants.TYPE_SVCB,
+	"HTTPS":  constants.TYPE_HTTPS,
+	"CAA":    constants.TYPE_CAA,
+}
+
+// Multipliers of the units allowed in TTLs, such as `1h30m'
+var ttlUnits = map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+
+// ParseType converts a type mnemonic such as `AAAA' or `TYPE65' into its value
+func ParseType(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	if t, ok := typeNames[s]; ok {
+		return t, nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		if t, err := strconv.ParseUint(s[4:], 10, 16); err == nil {
+			return uint16(t), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown type %q", s)
+}
+
+// ZoneParser reads resource records in master file format (RFC 1035 5)
+type ZoneParser struct {
+	origin     Namelabel  // completes relative names, changed by $ORIGIN
+	defaultTtl *uint32    // TTL set by $TTL (RFC 2308 4)
+	lastTtl    *uint32    // TTL of the previous record, used if there is no $TTL
+	owner      *Namelabel // owner of the previous record
+	dir        string     // base of relative $INCLUDE paths
+	depth      int        // nesting level of $INCLUDE
+}
+
+func NewZoneParser(origin Namelabel) *ZoneParser {
+	return &ZoneParser{origin: origin}
+}
+
+// SetDefaultTtl sets the TTL of records without one, as if the input started with $TTL
+func (zp *ZoneParser) SetDefaultTtl(ttl uint32) {
+	zp.defaultTtl = &ttl
+}
+
+// ParseZone reads all records of a master file from r, completing
+// relative names with origin
+func ParseZone(r io.Reader, origin Namelabel) ([]ResourceRecordFormat, error) {
+	return NewZoneParser(origin).Parse(r)
+}
+
+// ParseZoneFile reads all records of the master file at path, completing
+// relative names with origin
+func ParseZoneFile(path string, origin Namelabel) ([]ResourceRecordFormat, error) {
+	return NewZoneParser(origin).ParseFile(path)
+}
+
+// ParseFile reads the master file at path. Relative $INCLUDE paths
+// are resolved from its directory.
+func (zp *ZoneParser) ParseFile(path string) ([]ResourceRecordFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zp.dir = filepath.Dir(path)
+	rrs, err := zp.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rrs, nil
+}
+
+// Parse reads all records from r
+func (zp *ZoneParser) Parse(r io.Reader) ([]ResourceRecordFormat, error) {
+	rrs := make([]ResourceRecordFormat, 0)
+	lx := &zoneLexer{scanner: bufio.NewScanner(r)}
+	for {
+		tokens, blank, err := lx.next()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lx.start, err)
+		}
+		if tokens == nil {
+			return rrs, nil
+		}
+
+		if !blank && strings.HasPrefix(tokens[0], "$") {
+			included, err := zp.parseDirective(tokens)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lx.start, err)
+			}
+			rrs = append(rrs, included...)
+			continue
+		}
+
+		rr, err := zp.parseRecord(tokens, blank)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lx.start, err)
+		}
+		rrs = append(rrs, rr)
+	}
+}
+
+// parseDirective handles $ORIGIN, $TTL and $INCLUDE.
+// Returns the records of included files.
+func (zp *ZoneParser) parseDirective(tokens []string) ([]ResourceRecordFormat, error) {
+	switch d := strings.ToUpper(tokens[0]); {
+	case d == "$ORIGIN" && len(tokens) == 2:
+		origin, err := parseZoneName(tokens[1], zp.origin)
+		if err != nil {
+			return nil, err
+		}
+		zp.origin = origin
+	case d == "$TTL" && len(tokens) == 2:
+		ttl, err := parseTtl(tokens[1])
+		if err != nil {
+			return nil, err
+		}
+		zp.defaultTtl = &ttl
+	case d == "$INCLUDE" && (len(tokens) == 2 || len(tokens) == 3):
+		return zp.include(tokens[1:])
+	default:
+		return nil, fmt.Errorf("Invalid directive %v", tokens)
+	}
+	return nil, nil
+}
+
+// include parses the file named by args[0] using the origin in args[1], if given.
+// The included file does not change the state of this parser (RFC 1035 5.1).
+func (zp *ZoneParser) include(args []string) ([]ResourceRecordFormat, error) {
+	if zp.depth >= MAX_INCLUDE_DEPTH {
+		return nil, fmt.Errorf("$INCLUDE nested deeper than %d", MAX_INCLUDE_DEPTH)
+	}
+	path, err := unescapeText(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(zp.dir, path)
+	}
+
+	child := &ZoneParser{origin: zp.origin, defaultTtl: zp.defaultTtl, lastTtl: zp.lastTtl, depth: zp.depth + 1}
+	if len(args) == 2 {
+		if child.origin, err = parseZoneName(args[1], zp.origin); err != nil {
+			return nil, err
+		}
+	}
+	return child.ParseFile(path)
+}
+
+// parseRecord parses a `[<owner>] [<TTL>] [<class>] <type> <RDATA>' entry.
+// Entries starting with a blank use the owner of the previous record.
+func (zp *ZoneParser) parseRecord(tokens []string, blank bool) (ResourceRecordFormat, error) {
+	rr := ResourceRecordFormat{Class: constants.CLASS_IN}
+	if !blank {
+		owner, err := parseZoneName(tokens[0], zp.origin)
+		if err != nil {
+			return rr, err
+		}
+		zp.owner = &owner
+		tokens = tokens[1:]
+	}
+	if zp.owner == nil {
+		return rr, fmt.Errorf("Record without owner")
+	}
+
+	ttl := zp.defaultTtl
+	if ttl == nil {
+		ttl = zp.lastTtl
+	}
+	// TTL and class may appear in any order
+	for i := 0; i < 2 && len(tokens) > 0; i++ {
+		if v, err := parseTtl(tokens[0]); err == nil {
+			ttl = &v
+			tokens = tokens[1:]
+		} else if c := strings.ToUpper(tokens[0]); c == "IN" || c == "CLASS1" {
+			tokens = tokens[1:]
+		} else if c == "CH" || c == "HS" || strings.HasPrefix(c, "CLASS") {
+			return rr, fmt.Errorf("Unsupported class %s", tokens[0])
+		}
+	}
+	if ttl == nil {
+		return rr, fmt.Errorf("Record without TTL")
+	}
+	if len(tokens) == 0 {
+		return rr, fmt.Errorf("Record without type")
+	}
+
+	t, err := ParseType(tokens[0])
+	if err != nil {
+		return rr, err
+	}
+	rdata, err := ParseTextRdata(t, tokens[1:], zp.origin)
+	if err != nil {
+		return rr, err
+	}
+
+	zp.lastTtl = ttl
+	rr.Name = *zp.owner
+	rr.Type = t
+	rr.Ttl = *ttl
+	rr.Data = rdata.Assemble()
+	return rr, nil
+}
+
+// zoneLexer splits a master file into entries
+type zoneLexer struct {
+	scanner *bufio.Scanner
+	line    int // number of lines read
+	start   int // first line of the current entry
+}
+
+// next returns the tokens of the next entry, which spans multiple lines if
+// parentheses are used. Escapes are kept, quotes are removed. blank is set
+// if the entry starts with a blank. Returns nil tokens at the end of the input.
+func (lx *zoneLexer) next() (tokens []string, blank bool, err error) {
+	depth := 0
+	for lx.scanner.Scan() {
+		lx.line++
+		line := lx.scanner.Text()
+		if depth == 0 && len(tokens) == 0 {
+			lx.start = lx.line
+			blank = len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+		}
+		if tokens, err = splitZoneLine(line, tokens, &depth); err != nil {
+			return nil, false, err
+		}
+		if depth == 0 && len(tokens) > 0 {
+			return tokens, blank, nil
+		}
+	}
+	if err := lx.scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	if depth != 0 {
+		return nil, false, fmt.Errorf("Unbalanced parentheses")
+	}
+	return nil, false, nil
+}
+
+// splitZoneLine appends the whitespace separated tokens of line to tokens,
+// dropping comments and tracking the nesting of parentheses in depth
+func splitZoneLine(line string, tokens []string, depth *int) ([]string, error) {
+	var field strings.Builder
+	inField, quoted := false, false
+	flush := func() {
+		if inField {
+			tokens = append(tokens, field.String())
+			field.Reset()
+			inField = false
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(line) {
+				return nil, fmt.Errorf("Incomplete escape at end of line")
+			}
+			field.WriteByte(c)
+			field.WriteByte(line[i+1])
+			inField = true
+			i++
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case quoted:
+			field.WriteByte(c)
+		case c == ';':
+			i = len(line)
+		case c == '(':
+			flush()
+			*depth++
+		case c == ')':
+			flush()
+			if *depth == 0 {
+				return nil, fmt.Errorf("Unbalanced parentheses")
+			}
+			*depth--
+		case c == ' ' || c == '\t' || c == '\r':
+			flush()
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("Unterminated quoted string")
+	}
+	flush()
+	return tokens, nil
+}
+
+// parseZoneName converts a name of a master file, which might be
+// relative to origin or `@' for the origin itself
+func parseZoneName(s string, origin Namelabel) (Namelabel, error) {
+	if s == "@" {
+		return origin, nil
+	}
+	n, absolute, err := parseTextLabels(s)
+	if err != nil || absolute {
+		return n, err
+	}
+
+	// relative name: replace the root label with the origin
+	n.name = append(n.name[:len(n.name)-1], origin.name...)
+	if len(EncodeName(n)) > constants.MAX_SIZE_NAME {
+		return Namelabel{}, fmt.Errorf("Name %q is too long", s)
+	}
+	return n, nil
+}
+
+// parseTtl parses a TTL in seconds, which may also be given
+// using units such as `1h30m'
+func parseTtl(s string) (uint32, error) {
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+
+	total, n, digits := uint64(0), uint64(0), false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			n = n*10 + uint64(c-'0')
+			digits = true
+		} else if unit, ok := ttlUnits[c|0x20]; ok && digits {
+			total += n * unit
+			n, digits = 0, false
+		} else {
+			return 0, fmt.Errorf("Invalid TTL %q", s)
+		}
+		if n > math.MaxUint32 || total > math.MaxUint32 {
+			return 0, fmt.Errorf("TTL %q is too large", s)
+		}
+	}
+	if len(s) == 0 || digits {
+		return 0, fmt.Errorf("Invalid TTL %q", s)
+	}
+	return uint32(total), nil
+}
+
+// ParseTextRdata converts the presentation format of RDATA with type t
+// into its typed representation. Relative names are completed using origin.
+// The generic format of RFC 3597 (`\# <length> <hex>') is accepted for all types.
+func ParseTextRdata(t uint16, fields []string, origin Namelabel) (Rdata, error) {
+	if len(fields) > 0 && fields[0] == "\\#" {
+		return parseGenericRdata(t, fields[1:])
+	}
+
+	f := &textFields{fields: fields, origin: origin}
+	var rd Rdata
+	switch t {
+	case constants.TYPE_A:
+		rd = &RdataA{Addr: f.ip(true)}
+	case constants.TYPE_AAAA:
+		rd = &RdataAaaa{Addr: f.ip(false)}
+	case constants.TYPE_NS:
+		rd = &RdataNs{Name: f.name()}
+	case constants.TYPE_CNAME:
+		rd = &RdataCname{Name: f.name()}
+	case constants.TYPE_PTR:
+		rd = &RdataPtr{Name: f.name()}
+	case constants.TYPE_DNAME:
+		rd = &RdataDname{Name: f.name()}
+	case constants.TYPE_SOA:
+		rd = &RdataSoa{Mname: f.name(), Rname: f.name(), Serial: f.u32(), Refresh: f.ttl(), Retry: f.ttl(), Expire: f.ttl(), Minimum: f.ttl()}
+	case constants.TYPE_MX:
+		rd = &RdataMx{Preference: f.u16(), Exchange: f.name()}
+	case constants.TYPE_TXT:
+		txt := &RdataTxt{}
+		for len(f.fields) > 0 && f.err == nil {
+			txt.Strings = append(txt.Strings, f.charString())
+		}
+		if len(txt.Strings) == 0 {
+			f.err = fmt.Errorf("Empty TXT record")
+		}
+		rd = txt
+	case constants.TYPE_SRV:
+		rd = &RdataSrv{Priority: f.u16(), Weight: f.u16(), Port: f.u16(), Target: f.name()}
+	case constants.TYPE_NAPTR:
+		rd = &RdataNaptr{Order: f.u16(), Preference: f.u16(), Flags: f.charString(), Services: f.charString(), Regexp: f.charString(), Replacement: f.name()}
+	case constants.TYPE_CAA:
+		rd = &RdataCaa{Flags: uint8(f.uint(8)), Tag: f.next(), Value: f.text()}
+	case constants.TYPE_SVCB, constants.TYPE_HTTPS:
+		rd = &RdataSvcb{Priority: f.u16(), Target: f.name(), Params: f.svcParams()}
+	default:
+		return nil, fmt.Errorf("Type %d can only be given in the generic format", t)
+	}
+
+	if f.err == nil && len(f.fields) > 0 {
+		f.err = fmt.Errorf("Trailing data: %v", f.fields)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return rd, nil
+}
+
+// parseGenericRdata parses the `<length> <hex>...' format of RFC 3597 5
+func parseGenericRdata(t uint16, fields []string) (Rdata, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Missing RDATA length")
+	}
+	size, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(size) {
+		return nil, fmt.Errorf("RDATA has %d bytes, expected %d", len(data), size)
+	}
+	return ParseRdata(t, data)
+}
+
+// parseSvcParam parses a single `key=value' SvcParam (RFC 9460 2.1)
+func parseSvcParam(s string) (SvcParam, error) {
+	p := SvcParam{}
+	kv := strings.SplitN(s, "=", 2)
+	key, err := parseSvcParamKey(kv[0])
+	if err != nil {
+		return p, err
+	}
+	p.Key = key
+	if key == 2 { // no-default-alpn
+		if len(kv) == 2 {
+			return p, fmt.Errorf("no-default-alpn does not take a value")
+		}
+		return p, nil
+	}
+	if len(kv) == 1 || kv[1] == "" {
+		if key < uint16(len(svcParamKeys)) {
+			return p, fmt.Errorf("SvcParam %s requires a value", kv[0])
+		}
+		return p, nil
+	}
+
+	value := kv[1]
+	switch key {
+	case 0, 1, 4, 6: // mandatory, alpn and the address hints are lists
+		items, err := splitValueList(value)
+		if err != nil {
+			return p, err
+		}
+		for _, item := range items {
+			switch key {
+			case 0:
+				k, err := parseSvcParamKey(item)
+				if err != nil {
+					return p, err
+				}
+				p.Value = append(p.Value, getU16Int(k)...)
+			case 1:
+				if len(item) == 0 || len(item) > 0xFF {
+					return p, fmt.Errorf("Invalid alpn-id %q", item)
+				}
+				p.Value = appendCharString(p.Value, item)
+			default:
+				ip := net.ParseIP(item)
+				if ip == nil || (ip.To4() != nil) != (key == 4) {
+					return p, fmt.Errorf("Invalid address hint %q", item)
+				}
+				if key == 4 {
+					ip = ip.To4()
+				}
+				p.Value = append(p.Value, ip...)
+			}
+		}
+	case 3: // port
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return p, err
+		}
+		p.Value = getU16Int(uint16(port))
+	case 5: // ech
+		if p.Value, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return p, err
+		}
+	default:
+		v, err := unescapeText(value)
+		if err != nil {
+			return p, err
+		}
+		p.Value = []byte(v)
+	}
+	return p, nil
+}
+
+// parseSvcParamKey converts a SvcParamKey such as `alpn' or `key65000' into its value
+func parseSvcParamKey(s string) (uint16, error) {
+	for i, name := range svcParamKeys {
+		if s == name {
+			return uint16(i), nil
+		}
+	}
+	if strings.HasPrefix(s, "key") {
+		if k, err := strconv.ParseUint(s[3:], 10, 16); err == nil && k != 65535 {
+			return uint16(k), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid SvcParamKey %q", s)
+}
+
+// splitValueList splits a SvcParam value at commas after removing
+// one level of escaping, so `\,' keeps a comma in an item (RFC 9460 A.1)
+func splitValueList(s string) ([]string, error) {
+	s, err := unescapeText(s)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]string, 0)
+	item := make([]byte, 0)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			item = append(item, s[i+1])
+			i++
+		case s[i] == ',':
+			items = append(items, string(item))
+			item = item[:0]
+		default:
+			item = append(item, s[i])
+		}
+	}
+	return append(items, string(item)), nil
+}
+
+// textFields consumes RDATA fields, remembering the first error
+type textFields struct {
+	fields []string
+	origin Namelabel
+	err    error
+}
+
+func (f *textFields) next() string {
+	if f.err == nil && len(f.fields) == 0 {
+		f.err = fmt.Errorf("Missing RDATA field")
+	}
+	if f.err != nil {
+		return ""
+	}
+	s := f.fields[0]
+	f.fields = f.fields[1:]
+	return s
+}
+
+func (f *textFields) uint(bits int) uint64 {
+	s := f.next()
+	if f.err != nil {
+		return 0
+	}
+	v, err := strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		f.err = err
+	}
+	return v
+}
+
+func (f *textFields) u16() uint16 {
+	return uint16(f.uint(16))
+}
+
+func (f *textFields) u32() uint32 {
+	return uint32(f.uint(32))
+}
+
+// ttl parses a time value, which may use units (`1h')
+func (f *textFields) ttl() uint32 {
+	s := f.next()
+	if f.err != nil {
+		return 0
+	}
+	v, err := parseTtl(s)
+	if err != nil {
+		f.err = err
+	}
+	return v
+}
+
+// text returns the next field with all escapes removed
+func (f *textFields) text() string {
+	s := f.next()
+	if f.err != nil {
+		return ""
+	}
+	v, err := unescapeText(s)
+	if err != nil {
+		f.err = err
+	}
+	return v
+}
+
+func (f *textFields) charString() string {
+	s := f.text()
+	if f.err == nil && len(s) > 0xFF {
+		f.err = fmt.Errorf("String %q is too long", s)
+	}
+	return s
+}
+
+func (f *textFields) name() Namelabel {
+	s := f.next()
+	if f.err != nil {
+		return Namelabel{}
+	}
+	n, err := parseZoneName(s, f.origin)
+	if err != nil {
+		f.err = err
+	}
+	return n
+}
+
+// ip parses an IPv4 address if v4 is set, an IPv6 address otherwise
+func (f *textFields) ip(v4 bool) net.IP {
+	s := f.next()
+	if f.err != nil {
+		return nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		f.err = fmt.Errorf("Invalid address %q", s)
+		return nil
+	}
+	if v4 {
+		return ip.To4()
+	}
+	return ip
+}
+
+// svcParams parses all remaining fields as SvcParams, which
+// are sorted by key as required on the wire (RFC 9460 2.2)
+func (f *textFields) svcParams() []SvcParam {
+	params := make([]SvcParam, 0)
+	for len(f.fields) > 0 && f.err == nil {
+		p, err := parseSvcParam(f.next())
+		if err != nil {
+			f.err = err
+		}
+		params = append(params, p)
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i].Key < params[j].Key })
+	for i := 1; i < len(params) && f.err == nil; i++ {
+		if params[i].Key == params[i-1].Key {
+			f.err = fmt.Errorf("Duplicate SvcParam %s", svcParamKeyName(params[i].Key))
+		}
+	}
+	return params
+}
@@ -0,0 +1,114 @@
+package packet
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseZone(t *testing.T) {
+	origin, _ := ParseTextName("example.com")
+	input := `; a comment
+@      3600 IN SOA ns hostmaster 1 7200 900 1209600 300
+       IN 600  NS  ns.example.com.
+ns          A   192.0.2.1 ; trailing
+www    60   CNAME ns
+txt         TXT "hello world" two
+raw         TYPE99 \# 2 abcd
+`
+	rrs, err := ParseZone(strings.NewReader(input), origin)
+	if err != nil {
+		panic(err)
+	}
+	if len(rrs) != 6 {
+		panic(fmt.Errorf("Expected 6 records, got %d", len(rrs)))
+	}
+
+	expect := []struct {
+		name string
+		t    uint16
+		ttl  uint32
+		data string
+	}{
+		{"example.com.", constants.TYPE_SOA, 3600, "ns.example.com. hostmaster.example.com. 1 7200 900 1209600 300"},
+		{"example.com.", constants.TYPE_NS, 600, "ns.example.com."},
+		{"ns.example.com.", constants.TYPE_A, 600, "192.0.2.1"},
+		{"www.example.com.", constants.TYPE_CNAME, 60, "ns.example.com."},
+		{"txt.example.com.", constants.TYPE_TXT, 60, `"hello world" "two"`},
+		{"raw.example.com.", 99, 60, `\# 2 abcd`},
+	}
+	for i, e := range expect {
+		rr := rrs[i]
+		rd, err := ParseRdata(rr.Type, rr.Data)
+		if err != nil {
+			panic(err)
+		}
+		if rr.Name.String() != e.name || rr.Type != e.t || rr.Ttl != e.ttl || rd.String() != e.data {
+			panic(fmt.Errorf("Record %d: got %v %d %d %q", i, &rr.Name, rr.Type, rr.Ttl, rd.String()))
+		}
+	}
+
+	for _, bad := range []string{"x A 192.0.2.1\n", " 60 A 192.0.2.1\n", "x 60 A 2001:db8::1\n", "x 60 TXT \"open\n", "x 60 MX 10\n", "x 60 BOGUS 1\n"} {
+		if _, err := ParseZone(strings.NewReader(bad), origin); err == nil {
+			panic(fmt.Errorf("Expected %q to fail", bad))
+		}
+	}
+}
+
+func TestZoneDirectives(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "inc.zone"), []byte("host A 192.0.2.9\n"), 0644); err != nil {
+		panic(err)
+	}
+	input := `$TTL 1h
+$ORIGIN example.com.
+@   IN SOA ns hostmaster (
+            2024010101 ; serial
+            2h 15m 2w 5m )
+a\.b    TXT "quoted \"text\" ; no comment" \065
+$ORIGIN sub
+www  30 A   192.0.2.1
+     AAAA   2001:db8::1
+$INCLUDE inc.zone other.example.
+svc  HTTPS  1 . port=8443 alpn=h3,h2 ipv4hint=192.0.2.1,192.0.2.2
+`
+	path := filepath.Join(dir, "main.zone")
+	if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+		panic(err)
+	}
+	root, _ := ParseTextName(".")
+	rrs, err := ParseZoneFile(path, root)
+	if err != nil {
+		panic(err)
+	}
+
+	expect := []string{
+		`example.com. 3600 6 ns.example.com. hostmaster.example.com. 2024010101 7200 900 1209600 300`,
+		`a\.b.example.com. 3600 16 "quoted \"text\" ; no comment" "A"`,
+		`www.sub.example.com. 30 1 192.0.2.1`,
+		`www.sub.example.com. 3600 28 2001:db8::1`,
+		`host.other.example. 3600 1 192.0.2.9`,
+		`svc.sub.example.com. 3600 65 1 . alpn="h3,h2" port=8443 ipv4hint=192.0.2.1,192.0.2.2`,
+	}
+	if len(rrs) != len(expect) {
+		panic(fmt.Errorf("Expected %d records, got %d", len(expect), len(rrs)))
+	}
+	for i, rr := range rrs {
+		rd, err := ParseRdata(rr.Type, rr.Data)
+		if err != nil {
+			panic(err)
+		}
+		if s := fmt.Sprintf("%v %d %d %v", &rr.Name, rr.Ttl, rr.Type, rd); s != expect[i] {
+			panic(fmt.Errorf("Record %d: got %s, expected %s", i, s, expect[i]))
+		}
+	}
+
+	for _, bad := range []string{"$TTL 1x\n", "$BOGUS x\n", "x 60 A ( 192.0.2.1\n", "x 60 A 192.0.2.1 )\n", "x 60 CH TXT a\n", "x 60 TXT \\06\n", "$INCLUDE missing.zone\n", "x 60 SVCB 1 . port=1 port=2\n"} {
+		if _, err := ParseZone(strings.NewReader(bad), root); err == nil {
+			panic(fmt.Errorf("Expected %q to fail", bad))
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"sync"
+	"time"
+)
+
+type qCtx struct {
+	context context.Context
+	cancel  context.CancelFunc
+	budget  *queryBudget
+}
+
+// The resources a client query may use. The budget is shared
+// by all sub-lookups spawned to answer the same query.
+type queryBudget struct {
+	sync.Mutex
+	cnames  int
+	queries int
+	reason  string // why the budget was exhausted, empty if it was not
+}
+
+// newQCtx returns a new query context expiring at deadline
+func newQCtx(deadline time.Time) *qCtx {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	return &qCtx{context: ctx, cancel: cancel, budget: &queryBudget{}}
+}
+
+// done returns true if lookups of this context should give up
+func (qctx *qCtx) done() bool {
+	return qctx.context.Err() != nil || qctx.budget.exhausted() != ""
+}
+
+// spendCname accounts for following a CNAME, returns false if the chain got too long
+func (b *queryBudget) spendCname() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.cnames++
+	if b.cnames > constants.MAX_CNAME_CHAIN {
+		b.exhaust(fmt.Sprintf("CNAME chain longer than %d", constants.MAX_CNAME_CHAIN))
+	}
+	return b.reason == ""
+}
+
+// spendQuery accounts for an upstream query, returns false if we sent too many
+func (b *queryBudget) spendQuery() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.queries++
+	if b.queries > constants.MAX_UPSTREAM_QUERIES {
+		b.exhaust(fmt.Sprintf("more than %d upstream queries", constants.MAX_UPSTREAM_QUERIES))
+	}
+	return b.reason == ""
+}
+
+// checkReferrals returns false if a lookup followed too many referrals
+func (b *queryBudget) checkReferrals(referrals int) bool {
+	b.Lock()
+	defer b.Unlock()
+	if referrals > constants.MAX_REFERRAL_DEPTH {
+		b.exhaust(fmt.Sprintf("more than %d referrals", constants.MAX_REFERRAL_DEPTH))
+	}
+	return b.reason == ""
+}
+
+// exhausted returns the reason why the budget ran out, or an empty string
+func (b *queryBudget) exhausted() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.reason
+}
+
+// exhaust marks the budget as used up, keeping the first reason. Must be called locked.
+func (b *queryBudget) exhaust(reason string) {
+	if b.reason == "" {
+		b.reason = reason
+	}
+}
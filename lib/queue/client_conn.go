@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"net"
+	"sync"
+	"time"
+)
+
+// ClientConn describes the transport used to deliver
+// a reply to the client which sent the query
+type ClientConn interface {
+	WriteReply(data []byte) error
+}
+
+// UdpClient sends replies as a single datagram via the
+// socket the query was received on
+type UdpClient struct {
+	conn   *net.UDPConn
+	remote *net.UDPAddr
+}
+
+// NewUdpClient returns a ClientConn replying to remote via conn
+func NewUdpClient(conn *net.UDPConn, remote *net.UDPAddr) *UdpClient {
+	return &UdpClient{conn: conn, remote: remote}
+}
+
+func (uc *UdpClient) WriteReply(data []byte) error {
+	_, err := uc.conn.WriteToUDP(data, uc.remote)
+	return err
+}
+
+// TcpClient sends length-prefixed replies via a TCP stream.
+// Clients may pipeline queries, so replies are serialized and
+// might be sent out of order (RFC 7766 6.2.1.1)
+type TcpClient struct {
+	sync.Mutex
+	conn    net.Conn
+	pending sync.WaitGroup
+}
+
+// NewTcpClient returns a ClientConn replying via conn
+func NewTcpClient(conn net.Conn) *TcpClient {
+	return &TcpClient{conn: conn}
+}
+
+// Track registers an outstanding query, which will
+// be answered by a call to WriteReply
+func (tc *TcpClient) Track() {
+	tc.pending.Add(1)
+}
+
+func (tc *TcpClient) WriteReply(data []byte) error {
+	defer tc.pending.Done()
+	tc.Lock()
+	defer tc.Unlock()
+	tc.conn.SetWriteDeadline(time.Now().Add(constants.TIMEOUT_TCP_WRITE))
+	return packet.WriteTcpFrame(tc.conn, data)
+}
+
+// Close closes the underlying connection as soon
+// as all tracked queries were answered
+func (tc *TcpClient) Close() error {
+	tc.pending.Wait()
+	return tc.conn.Close()
+}
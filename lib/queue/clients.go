@@ -1,20 +1,18 @@
 package queue
 
 import (
-	"context"
-	"fmt"
 	"github.com/adrian-bl/rna/lib/cache"
 	"github.com/adrian-bl/rna/lib/constants"
 	l "github.com/adrian-bl/rna/lib/log"
 	"github.com/adrian-bl/rna/lib/packet"
-	"math/rand"
 	"net"
 	"time"
 )
 
 // A (parsed) request sent by a client
 type clientRequest struct {
-	Query *packet.ParsedPacket
+	Query   *packet.ParsedPacket
+	MaxSize int // max size of the reply we may send to this client
 }
 
 // The result of a lookup operation
@@ -29,77 +27,215 @@ const (
 	LR_TIMEOUT  = 2
 )
 
-type qCtx struct {
-	context context.Context
-	cancel  context.CancelFunc
-}
+// Address families used to contact upstream nameservers
+const (
+	AF_PREFER_V4 = iota
+	AF_PREFER_V6
+	AF_ONLY_V4
+	AF_ONLY_V6
+)
 
 // Starts the lookup of a new client request
-func (cq *Cq) AddClientRequest(query *packet.ParsedPacket, remote *net.UDPAddr) {
-	d := time.Now().Add(6500 * time.Millisecond)
-	ctx, cancel := context.WithDeadline(context.Background(), d)
+func (cq *Cq) AddClientRequest(query *packet.ParsedPacket, client ClientConn) {
+	qctx := newQCtx(time.Now().Add(constants.TIMEOUT_LOOKUP))
 	go func() {
-		// FIXME: This should be done lazely, otherwise we create a socket for cache hits.
-		sconn, err := cq.newServerReader()
-		if err != nil {
-			panic(err)
-		}
-		defer sconn.Close()
+		cr := &clientRequest{Query: query, MaxSize: cq.replySize(query, client)}
+		cq.writeReply(client, cq.clientLookup(cr, qctx))
+	}()
+}
 
-		qctx := &qCtx{context: ctx, cancel: cancel}
-		data, err := cq.clientLookup(&clientRequest{Query: query}, sconn, qctx)
-		if err == nil {
-			cq.rconn.WriteToUDP(data, remote)
-		} else {
-			panic(err)
+// SendError answers query with an empty reply carrying rcode
+func (cq *Cq) SendError(query *packet.ParsedPacket, client ClientConn, rcode uint8) {
+	cr := &clientRequest{Query: query, MaxSize: cq.replySize(query, client)}
+	cq.writeReply(client, cq.errorReply(cr, rcode))
+}
+
+// writeReply sends data to client, failures are only logged as there
+// is nothing else we could do about them
+func (cq *Cq) writeReply(client ClientConn, data []byte) {
+	if err := client.WriteReply(data); err != nil {
+		l.Debug("failed to send reply: %v", err)
+	}
+}
+
+// clientLookup resolves the query of cr and returns the assembled reply
+func (cq *Cq) clientLookup(cr *clientRequest, qctx *qCtx) []byte {
+	refreshing := false // the lookup continues after we answered with stale data
+	defer func() {
+		if !refreshing {
+			qctx.cancel()
 		}
 	}()
-}
 
-func (cq *Cq) clientLookup(cr *clientRequest, sconn *net.UDPConn, qctx *qCtx) ([]byte, error) {
 	// Ensure that this query makes some sense
 	if len(cr.Query.Questions) != 1 {
-		return nil, fmt.Errorf("Expected query with 1 question, had %d", len(cr.Query.Questions))
+		l.Debug("expected query with 1 question, had %d", len(cr.Query.Questions))
+		return cq.errorReply(cr, constants.RC_FORM_ERR)
+	}
+
+	if cr.Query.Edns != nil && cr.Query.Edns.Version != 0 {
+		// RFC 6891 6.1.3: we only speak EDNS version 0
+		p := cq.newReply(cr)
+		p.Edns.ExtRcode = constants.RC_BAD_VERS >> 4
+		return packet.Assemble(p)
 	}
 
 	q := cr.Query.Questions[0]
-	c := make(chan *lookupRes)
-	go cq.collapsedLookup(q, c, sconn, qctx)
-	lres := <-c
-	qctx.cancel()
+	if a := cq.localZones.Lookup(q); a != nil {
+		p := cq.newReply(cr)
+		p.Header.Authoritative = true
+		p.Header.ResponseCode = a.Rcode
+		p.Answers = a.Answers
+		p.Nameservers = a.Authority
+		return packet.AssembleLimited(p, cr.MaxSize)
+	}
+
+	c := make(chan *lookupRes, 1)
+	go cq.collapsedLookup(q, c, qctx)
+	var lres *lookupRes
+	select {
+	case lres = <-c:
+	case <-cq.staleTimer():
+		if stale := cq.staleResult(cr); stale != nil {
+			l.Info("answering %v with stale data, lookup is still running", q.Name)
+			refreshing = true
+			go func() {
+				<-c
+				qctx.cancel()
+			}()
+			return cq.staleReply(cr, stale)
+		}
+		lres = <-c
+	}
+
+	security := cache.SEC_UNCHECKED
+	var dnssecRecords []packet.ResourceRecordFormat
+	if cq.validate && lres != nil && lres.status != LR_TIMEOUT {
+		security, dnssecRecords = cq.validateResult(q, lres, qctx)
+	}
 
 	l.Debug("final lookup reply -> %v", lres)
-	if lres != nil { // fixme: error
-		cres := lres.cres
-		p := &packet.ParsedPacket{}
-		p.Header.Id = cr.Query.Header.Id
-		p.Header.Response = true
-		p.Header.ResponseCode = cres.ResponseCode
-		p.Questions = cr.Query.Questions
-		switch lres.status {
-		case LR_POSITIVE:
-			p.Answers = append(p.Answers, cres.ResourceRecord...)
-		case LR_NEGATIVE:
-			p.Nameservers = append(p.Nameservers, cres.ResourceRecord...)
-		default:
-			// nil
-		}
-		return packet.Assemble(p), nil
-	}
-	return nil, fmt.Errorf("query returned lres: %+v; fixme: send error to client", lres)
+	if reason := qctx.budget.exhausted(); reason != "" {
+		return cq.failureReply(cr, reason)
+	}
+	if lres == nil {
+		return cq.failureReply(cr, "no server returned a usable reply")
+	}
+	if lres.status == LR_TIMEOUT {
+		return cq.failureReply(cr, "lookup timed out")
+	}
+	if security == cache.SEC_BOGUS && cr.Query.Header.CheckingDisabled == false {
+		l.Info("DNSSEC: refusing to return bogus data for %v", q.Name)
+		return cq.errorReply(cr, constants.RC_SERV_FAIL)
+	}
+
+	p := cq.resultReply(cr, lres)
+
+	// RFC 6840 5.8: only DNSSEC aware clients get signatures
+	dnssecOk := cr.Query.Edns != nil && cr.Query.Edns.DnssecOk
+	p.Header.AuthenticData = authenticData(cr, security)
+	if dnssecOk && lres.status == LR_POSITIVE {
+		p.Answers = append(p.Answers, dnssecRecords...)
+		p.Nameservers = append(p.Nameservers, lres.cres.Proof...) // wildcard answers need it
+	} else if dnssecOk && lres.status == LR_NEGATIVE {
+		p.Nameservers = append(p.Nameservers, dnssecRecords...)
+	}
+
+	return packet.AssembleLimited(p, cr.MaxSize)
+}
+
+// resultReply returns a reply to the query of cr carrying the records of lres
+func (cq *Cq) resultReply(cr *clientRequest, lres *lookupRes) *packet.ParsedPacket {
+	cres := lres.cres
+	p := cq.newReply(cr)
+	p.Header.ResponseCode = cres.ResponseCode
+	switch lres.status {
+	case LR_POSITIVE:
+		p.Answers = append(p.Answers, cres.ResourceRecord...)
+	case LR_NEGATIVE:
+		p.Nameservers = append(p.Nameservers, cres.ResourceRecord...)
+	}
+	return p
+}
+
+// authenticData returns true if the reply to cr may have the AD bit set:
+// only if its data is secure and the client understands DNSSEC (RFC 6840 5.7)
+func authenticData(cr *clientRequest, security int) bool {
+	dnssecOk := cr.Query.Edns != nil && cr.Query.Edns.DnssecOk
+	return security == cache.SEC_SECURE && (dnssecOk || cr.Query.Header.AuthenticData)
+}
+
+// failureReply is sent if we could not resolve the query of cr: stale
+// data if the cache still holds some (RFC 8767), SERVFAIL otherwise
+func (cq *Cq) failureReply(cr *clientRequest, reason string) []byte {
+	q := cr.Query.Questions[0]
+	if stale := cq.staleResult(cr); stale != nil {
+		l.Info("answering %v with stale data: %s", q.Name, reason)
+		return cq.staleReply(cr, stale)
+	}
+	l.Info("giving up on %v: %s", q.Name, reason)
+	return cq.errorReply(cr, constants.RC_SERV_FAIL)
+}
+
+// errorReply returns an empty reply to the query of cr with the given rcode
+func (cq *Cq) errorReply(cr *clientRequest, rcode uint8) []byte {
+	p := cq.newReply(cr)
+	p.Header.ResponseCode = rcode
+	return packet.AssembleLimited(p, cr.MaxSize)
+}
+
+// newReply returns an empty reply to the query of cr, carrying
+// an OPT RR if the client used EDNS
+func (cq *Cq) newReply(cr *clientRequest) *packet.ParsedPacket {
+	p := &packet.ParsedPacket{}
+	p.Header.Id = cr.Query.Header.Id
+	p.Header.Response = true
+	p.Header.Opcode = cr.Query.Header.Opcode
+	p.Header.RecDesired = cr.Query.Header.RecDesired
+	p.Header.CheckingDisabled = cr.Query.Header.CheckingDisabled
+	p.Questions = cr.Query.Questions
+	if cr.Query.Edns != nil {
+		p.Edns = &packet.EdnsOpt{UdpSize: cq.ednsSize, DnssecOk: cr.Query.Edns.DnssecOk}
+	}
+	return p
+}
+
+// replySize returns the max size of a reply which may be sent to client.
+// UDP clients are limited to 512 bytes unless they advertised a larger
+// EDNS buffer, which is capped to our own payload size.
+func (cq *Cq) replySize(query *packet.ParsedPacket, client ClientConn) int {
+	if _, ok := client.(*TcpClient); ok {
+		return constants.MAX_SIZE_TCP
+	}
+
+	size := constants.MAX_SIZE_UDP
+	if query.Edns != nil && int(query.Edns.UdpSize) > size {
+		size = int(query.Edns.UdpSize)
+		if size > int(cq.ednsSize) {
+			size = int(cq.ednsSize)
+		}
+	}
+	return size
 }
 
 // Our shiny lookup loop
-func (cq *Cq) collapsedLookup(q packet.QuestionFormat, c chan *lookupRes, sconn *net.UDPConn, qctx *qCtx) {
+func (cq *Cq) collapsedLookup(q packet.QuestionFormat, c chan *lookupRes, qctx *qCtx) {
+	tried := make(map[string]bool) // upstream servers we already sent this query to
+	referrals := 0
 
 	for i := 0; i < 5; {
 		if qctx.context.Err() != nil {
 			c <- &lookupRes{&cache.CacheResult{}, LR_TIMEOUT}
 			break
 		}
+		if qctx.done() {
+			break
+		}
 
+		// Glue and additional data are only good enough to contact
+		// nameservers, clients get an answer from the zone itself (RFC 2181 5.4.1)
 		cres, cerr := cq.cache.Lookup(q.Name, q.Type)
-		if cres != nil {
+		if cres != nil && cres.Rank >= cache.RANK_ANSWER {
 			c <- &lookupRes{cres, LR_POSITIVE}
 			break
 		}
@@ -110,15 +246,15 @@ func (cq *Cq) collapsedLookup(q packet.QuestionFormat, c chan *lookupRes, sconn
 
 		// No such type exists in cache, but maybe we got a CNAME... horray.
 		cres, _ = cq.cache.Lookup(q.Name, constants.TYPE_CNAME)
-		if cres != nil {
-			if len(cres.ResourceRecord) == 1 {
+		if cres != nil && cres.Rank >= cache.RANK_ANSWER {
+			if len(cres.ResourceRecord) == 1 && qctx.budget.spendCname() {
 				// We do not support weird multi-record cnames
 				target_label, err := packet.ParseName(cres.ResourceRecord[0].Data)
 				if err == nil {
 					// Restart query with cname label but inherit types of original query.
 					target_chan := make(chan *lookupRes)
 					target_q := packet.QuestionFormat{Name: target_label, Type: q.Type, Class: q.Class}
-					go cq.collapsedLookup(target_q, target_chan, sconn, qctx)
+					go cq.collapsedLookup(target_q, target_chan, qctx)
 					target_res := <-target_chan
 					if target_res != nil {
 						// not a dead cname: we got the requested record -> append it to original cache reply
@@ -130,68 +266,80 @@ func (cq *Cq) collapsedLookup(q packet.QuestionFormat, c chan *lookupRes, sconn
 			break
 		}
 
-		pp := cq.advanceCache(q, sconn, qctx)
-		progress := cq.blockForQuery(pp, qctx)
-		if progress == false {
-			i++
+		if qctx.budget.checkReferrals(referrals) == false || qctx.budget.spendQuery() == false {
+			break
+		}
+
+		w, ns, fresh := cq.advanceCache(q, qctx, tried)
+		tried[ns] = true
+		if cq.blockForQuery(w, qctx) {
+			referrals++
+		} else {
+			// only give up on this iteration if there was no other server left to try
+			if fresh == false {
+				i++
+			}
 		}
 	}
 	// return pseudio-nil if we give up
 	close(c)
 }
 
-func (cq *Cq) advanceCache(q packet.QuestionFormat, sconn *net.UDPConn, qctx *qCtx) *packet.ParsedPacket {
-	// our hardcoded, not so redundant slist
-	targetNS := "192.5.5.241:53"
+// advanceCache sends q to the best known nameserver of the closest enclosing zone.
+// Servers listed in tried are only used if no other server is left, in which
+// case fresh is false. The address of the queried server is returned in ns,
+// w is notified about the progress of the query.
+func (cq *Cq) advanceCache(q packet.QuestionFormat, qctx *qCtx, tried map[string]bool) (w *waiter, ns string, fresh bool) {
+	// start at the root if we know nothing about this name
 	targetXH := &packet.Namelabel{}
+	targetNS, fresh := cq.sq.infos.pick(cq.rootHintCandidates(), targetXH, tried)
 	targetQT := q.Type
 
-POP_LOOP:
-	for i := 0; ; i++ {
+	// DS records are served by the parent zone: skip the NS of the queried name
+	start := 0
+	if q.Type == constants.TYPE_DS && q.Name.Len() > 1 {
+		start = 1
+	}
+
+	fz := cq.forwardZone(q.Name)
+	if fz != nil {
+		// forwarded zones skip the delegation walk
+		targetXH = &fz.zone
+		targetNS, fresh = cq.sq.infos.pick(fz.servers, targetXH, tried)
+	}
+
+	for i := start; fz == nil; i++ {
 		label := q.Name.PoppedLabel(i) // removes 'i' labels from the label list
+		if stub := cq.stubs[label.ToKey()]; stub != nil {
+			// configured servers win over the public delegation of this zone
+			targetNS, fresh = cq.sq.infos.pick(stub.servers, &stub.zone, tried)
+			targetXH = &stub.zone
+			break
+		}
 		nsrec, _ := cq.cache.Lookup(*label, constants.TYPE_NS)
 
 		if nsrec != nil { // we got an NS cache entry for this level
-			var candidate_cres *cache.CacheResult
-			var candidate_label packet.Namelabel
+			candidates, unresolved := cq.nsCandidates(nsrec, label)
+			addr, ok := cq.sq.infos.pick(candidates, label, tried)
 
-			// loop trough all NS servers for this record
-			for _, candidate_data := range nsrec.ResourceRecord {
-				name, err := packet.ParseName(candidate_data.Data)
-				if err == nil {
-					l.Debug("NS %v handles %v", name, label)
-					cres, _ := cq.cache.Lookup(name, constants.TYPE_A)
-					if cres != nil {
-						candidate_cres = cres
-					} else {
-						candidate_label = name
+			// Resolve all yet unknown nameservers, even if we got a candidate:
+			// the one we are contacting might fail for some reason.
+			if len(unresolved) > 0 {
+				found := cq.resolveNsAddresses(unresolved, qctx)
+				for ok == false {
+					// all known servers were tried: wait for the next lookup to finish
+					more, open := <-found
+					if open == false {
+						break
 					}
+					candidates = append(candidates, more...)
+					addr, ok = cq.sq.infos.pick(candidates, label, tried)
 				}
 			}
-
-			// Fixme: We should try to resolve (yet unknown) nameservers
-			// even if we got a candidate_res as the one we are contacting
-			// might fail for some reason.
-
-			if candidate_cres == nil && candidate_label.Len() > 0 {
-				l.Debug("Looking up IP of known candidate: %v", candidate_label)
-				c := make(chan *lookupRes)
-				go cq.collapsedLookup(packet.QuestionFormat{Type: constants.TYPE_A, Class: constants.CLASS_IN, Name: candidate_label}, c, sconn, qctx)
-				lres := <-c
-				if lres != nil && lres.status == LR_POSITIVE {
-					candidate_cres = lres.cres
-				}
-			}
-			if candidate_cres != nil {
-				l.Debug("We got an RR: %v", candidate_cres)
-				for _, v := range candidate_cres.ResourceRecord {
-					if v.Type != constants.TYPE_A {
-						l.Panic("Not an A type: %v", v)
-					}
-					targetNS = fmt.Sprintf("%d.%d.%d.%d:53", v.Data[0], v.Data[1], v.Data[2], v.Data[3])
-					targetXH = label
-					break POP_LOOP
-				}
+			if addr != "" {
+				targetNS, fresh = addr, ok
+				targetXH = label
+				break
 			}
 		}
 		if label.Len() == 1 {
@@ -200,17 +348,80 @@ POP_LOOP:
 	}
 
 	pp := &packet.ParsedPacket{}
-	pp.Header.Id = uint16(rand.Uint32()) // will simply overflow
+	pp.Header.Id = randomUint16()
 	pp.Header.Opcode = constants.OP_QUERY
+	pp.Header.RecDesired = fz != nil // forwarders resolve the query for us
 	pp.Header.QuestionCount = 1
-	pp.Questions = []packet.QuestionFormat{{Name: *q.Name.ShuffleCases(), Class: constants.CLASS_IN, Type: targetQT}}
+	pp.Questions = []packet.QuestionFormat{{Name: q.Name, Class: constants.CLASS_IN, Type: targetQT}}
+	if cq.sq.infos.preservesCase(targetNS) {
+		pp.Questions[0].Name = *q.Name.ShuffleCases()
+	}
+	pp.Edns = &packet.EdnsOpt{UdpSize: cq.ednsSize, DnssecOk: cq.validate}
 	remoteNs, err := net.ResolveUDPAddr("udp", targetNS)
 
+	w = cq.addWaiter(pp.Questions[0])
 	if err == nil {
-		l.Info("+ op=query, remote=%s, type=%d, id=%d, name=%v", targetNS, targetQT, pp.Header.Id, pp.Questions[0].Name)
-		sconn.WriteToUDP(packet.Assemble(pp), remoteNs)
-		cq.sq.registerQuery(pp.Questions[0], remoteNs, targetXH)
+		l.Info("+ op=query, remote=%s, type=%d, id=%d, rd=%v, name=%v", targetNS, targetQT, pp.Header.Id, pp.Header.RecDesired, pp.Questions[0].Name)
+		if err := cq.sendUdpQuery(pp, remoteNs, targetXH, fz != nil, qctx); err != nil {
+			l.Debug("failed to send query to %s: %v", targetNS, err)
+		}
+	}
+
+	return w, targetNS, fresh
+}
+
+// nsCandidates returns the known addresses of all nameservers in nsrec,
+// along with the names of all servers whose addresses are not cached
+func (cq *Cq) nsCandidates(nsrec *cache.CacheResult, zone *packet.Namelabel) ([]nsCandidate, []packet.Namelabel) {
+	candidates := make([]nsCandidate, 0)
+	unresolved := make([]packet.Namelabel, 0)
+
+	// loop trough all NS servers for this record
+	for _, candidate_data := range nsrec.ResourceRecord {
+		name, err := packet.ParseName(candidate_data.Data)
+		if err == nil {
+			l.Debug("NS %v handles %v", name, zone)
+			known := false
+			for rank, t := range cq.nsAddressTypes() {
+				if cres, _ := cq.cache.Lookup(name, t); cres != nil {
+					candidates = append(candidates, addressCandidates(cres, rank)...)
+					known = true
+				}
+			}
+			if known == false {
+				unresolved = append(unresolved, name)
+			}
+		}
 	}
+	return candidates, unresolved
+}
+
+// addressCandidates converts the A and AAAA records of cres into candidates of given rank
+func addressCandidates(cres *cache.CacheResult, rank int) []nsCandidate {
+	candidates := make([]nsCandidate, 0)
+	for _, v := range cres.ResourceRecord {
+		if isAddressRecord(v) {
+			candidates = append(candidates, nsCandidate{addr: net.JoinHostPort(net.IP(v.Data).String(), "53"), rank: rank})
+		}
+	}
+	return candidates
+}
+
+// nsAddressTypes returns the record types used to contact
+// nameservers, the most preferred address family first
+func (cq *Cq) nsAddressTypes() []uint16 {
+	switch cq.addrFamily {
+	case AF_ONLY_V4:
+		return []uint16{constants.TYPE_A}
+	case AF_ONLY_V6:
+		return []uint16{constants.TYPE_AAAA}
+	case AF_PREFER_V6:
+		return []uint16{constants.TYPE_AAAA, constants.TYPE_A}
+	}
+	return []uint16{constants.TYPE_A, constants.TYPE_AAAA}
+}
 
-	return pp
+// isAddressRecord returns true if rr holds a valid IPv4 or IPv6 address
+func isAddressRecord(rr packet.ResourceRecordFormat) bool {
+	return (rr.Type == constants.TYPE_A && len(rr.Data) == net.IPv4len) || (rr.Type == constants.TYPE_AAAA && len(rr.Data) == net.IPv6len)
 }
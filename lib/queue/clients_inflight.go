@@ -2,8 +2,12 @@ package queue
 
 import (
 	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/dnssec"
+	"github.com/adrian-bl/rna/lib/hints"
 	l "github.com/adrian-bl/rna/lib/log"
 	"github.com/adrian-bl/rna/lib/packet"
+	"github.com/adrian-bl/rna/lib/zone"
 	"net"
 	"sync"
 	"time"
@@ -11,39 +15,81 @@ import (
 
 type Cq struct {
 	sync.RWMutex
-	rconn    *net.UDPConn
-	cache    *cache.Cache
-	sq       *Sq
-	inflight map[string][]chan bool
+	cache      *cache.Cache
+	sq         *Sq
+	inflight   map[string][]chan bool
+	ednsSize   uint16 // EDNS(0) payload size advertised to upstream servers and clients
+	validate   bool   // `true' if DNSSEC validation is enabled
+	anchors    []*dnssec.Ds
+	addrFamily int // address family preference for upstream servers, one of AF_*
+	rootHints  []net.IP
+	nsLookups  map[string]*nsLookup // nameserver names whose addresses are being looked up
+	forwarders map[string]*zoneServers
+	stubs      map[string]*zoneServers
+	localZones *zone.Store
 }
 
-func NewClientQueue(rconn *net.UDPConn, cache *cache.Cache, sq *Sq) *Cq {
-	cq := &Cq{rconn: rconn, cache: cache, sq: sq, inflight: make(map[string][]chan bool, 0)}
+func NewClientQueue(cache *cache.Cache, sq *Sq) *Cq {
+	cq := &Cq{cache: cache, sq: sq, inflight: make(map[string][]chan bool, 0), nsLookups: make(map[string]*nsLookup), forwarders: make(map[string]*zoneServers), stubs: make(map[string]*zoneServers), localZones: zone.NewStore()}
+	cq.SetEdnsSize(constants.DEFAULT_SIZE_EDNS)
+	cq.SetRootHints(hints.Default())
 	cache.RegisterPutCallback(cq.handlePutCallback)
 	return cq
 }
 
-func (cq *Cq) blockForQuery(pp *packet.ParsedPacket, qctx *qCtx) bool {
-	cbi := &putCbItem{Key: pp.Questions[0].Name.ToKey(), Type: pp.Questions[0].Type}
-	key := cbi.ToString()
+// SetAddressFamily configures which address family (AF_*)
+// is used to talk to upstream nameservers
+func (cq *Cq) SetAddressFamily(af int) {
+	cq.addrFamily = af
+}
 
-	cq.Lock()
-	c := make(chan bool)
-	if cq.inflight[key] == nil {
-		cq.inflight[key] = make([]chan bool, 0)
+// SetEdnsSize configures the EDNS(0) UDP payload size we advertise.
+// Values outside of 512..MAX_SIZE_EDNS are clamped.
+func (cq *Cq) SetEdnsSize(size int) {
+	switch {
+	case size < constants.MAX_SIZE_UDP:
+		size = constants.MAX_SIZE_UDP
+	case size > constants.MAX_SIZE_EDNS:
+		size = constants.MAX_SIZE_EDNS
 	}
-	cq.inflight[key] = append(cq.inflight[key], c)
+	cq.ednsSize = uint16(size)
+}
+
+// waiter is notified about the progress of an upstream query
+type waiter struct {
+	key string
+	c   chan bool // closed on progress, receives a value on failure
+}
+
+// addWaiter registers interest in the progress of queries for q. This must
+// happen before the query is sent, so a fast reply can not be missed.
+func (cq *Cq) addWaiter(q packet.QuestionFormat) *waiter {
+	cbi := &putCbItem{Key: q.Name.ToKey(), Type: q.Type}
+	w := &waiter{key: cbi.ToString(), c: make(chan bool, 1)}
+
+	cq.Lock()
+	cq.inflight[w.key] = append(cq.inflight[w.key], w.c)
 	cq.Unlock()
+	return w
+}
 
-	l.Debug("Blocking for progress on %s", key)
+// blockForQuery waits until the query of w made some progress. Gives up
+// once the queried server can no longer reply in time: the reader of
+// the reply takes care of penalizing it.
+func (cq *Cq) blockForQuery(w *waiter, qctx *qCtx) bool {
+	l.Debug("Blocking for progress on %s", w.key)
 	select {
-	case <-c:
-		l.Debug("%s progressed", key)
+	case _, failed := <-w.c:
+		if failed {
+			l.Debug("%s failed", w.key)
+			return false
+		}
+		l.Debug("%s progressed", w.key)
 		return true
-	case <-time.After(time.Second * 2):
-		l.Debug("%s timed out!", key)
+	case <-time.After(constants.TIMEOUT_UDP_UPSTREAM):
+		l.Debug("%s timed out!", w.key)
 	case <-qctx.context.Done():
-		l.Debug("%s context deadline reached", key)
+		l.Debug("%s context deadline reached", w.key)
 	}
 	return false
 }
@@ -62,3 +108,17 @@ func (cq *Cq) handlePutCallback(isrc cache.InjectSource) {
 	}
 	cq.Unlock()
 }
+
+// handleFailCallback wakes up everyone waiting for q, telling them
+// that the queried server was unable to answer
+func (cq *Cq) handleFailCallback(q packet.QuestionFormat) {
+	cbi := &putCbItem{Key: q.Name.ToKey(), Type: q.Type}
+	key := cbi.ToString()
+
+	cq.Lock()
+	for _, c := range cq.inflight[key] {
+		c <- true
+	}
+	cq.inflight[key] = nil
+	cq.Unlock()
+}
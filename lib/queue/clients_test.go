@@ -0,0 +1,56 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGlueIsNoAnswer(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Close()
+	ns := server.LocalAddr().(*net.UDPAddr)
+
+	c := cache.NewNameCache()
+	sq := NewServerQueue(c)
+	cq := NewClientQueue(c, sq)
+	zone, _ := packet.ParseTextName("example")
+	cq.AddStubZone(zone, []*net.UDPAddr{ns})
+
+	// a referral caches the address of ns1.example as glue only
+	nsname, _ := packet.ParseTextName("ns1.example")
+	www := readerTestQuery("www.example")
+	sq.registerQuery(www.Questions[0], ns, &zone, false)
+	referral := &packet.ParsedPacket{Header: www.Header, Questions: www.Questions}
+	referral.Header.Response = true
+	referral.Nameservers = []packet.ResourceRecordFormat{{Name: zone, Type: constants.TYPE_NS, Class: constants.CLASS_IN, Ttl: 300, Data: packet.EncodeName(nsname)}}
+	referral.Additionals = []packet.ResourceRecordFormat{{Name: nsname, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 300, Data: []byte{192, 0, 2, 53}}}
+	c.Put(referral, ns)
+	if cres, _ := c.Lookup(nsname, constants.TYPE_A); cres == nil || cres.Rank != cache.RANK_GLUE {
+		panic(fmt.Errorf("Glue was not cached: %+v", cres))
+	}
+
+	// a client asking for the address must not get the glue
+	res := make(chan *lookupRes, 1)
+	go cq.collapsedLookup(packet.QuestionFormat{Name: nsname, Type: constants.TYPE_A, Class: constants.CLASS_IN}, res, newQCtx(time.Now().Add(200*time.Millisecond)))
+
+	buf := make([]byte, constants.MAX_SIZE_UDP)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	nread, _, err := server.ReadFromUDP(buf)
+	if err != nil {
+		panic(fmt.Errorf("Glue was returned instead of asking the zone: %v", err))
+	}
+	if p, err := packet.Parse(buf[0:nread]); err != nil || p.Questions[0].Name.ToKey() != nsname.ToKey() {
+		panic(fmt.Errorf("Unexpected upstream query: %+v, err=%v", p, err))
+	}
+	if lres := <-res; lres != nil && lres.status == LR_POSITIVE {
+		panic(fmt.Errorf("Glue was returned as answer: %+v", lres.cres))
+	}
+}
@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"github.com/adrian-bl/rna/lib/packet"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	RTT_UNKNOWN   = 200 * time.Millisecond // assumed RTT of servers we never talked to
+	RTT_MAX       = 5 * time.Second        // upper limit of the (penalized) RTT
+	RTT_LAME      = 10 * time.Second       // score of servers known to be lame for a zone
+	INFO_LIFETIME = 15 * time.Minute       // forget about servers we did not talk to in this time
+	CASE_MISSES   = 3                      // disable 0x20 for servers after this many replies with a mismatching case
+	INFO_MAX      = 10000                  // max. number of tracked addresses
+	INFO_SAMPLES  = 8                      // number of random entries compared to pick the one to forget
+)
+
+// nsInfo holds everything we learned about a single upstream address
+type nsInfo struct {
+	srtt     time.Duration        // smoothed round trip time
+	timeouts int                  // number of consecutive timeouts
+	lame     map[string]time.Time // zones this server is lame for, mapped to the expiry time
+	caseMiss int                  // number of replies which did not preserve the case of the question
+	updated  time.Time
+}
+
+// infoStore tracks the state of all upstream addresses
+type infoStore struct {
+	sync.Mutex
+	m map[string]*nsInfo
+}
+
+// nsCandidate is an address which may be used to query a zone
+type nsCandidate struct {
+	addr string // ip:port
+	rank int    // address family preference, lower is better
+}
+
+func newInfoStore() *infoStore {
+	return &infoStore{m: make(map[string]*nsInfo)}
+}
+
+// get returns the info of addr, creating a new entry if needed.
+// Must be called with the lock held.
+func (is *infoStore) get(addr string) *nsInfo {
+	i := is.m[addr]
+	if i == nil || time.Since(i.updated) > INFO_LIFETIME {
+		if i == nil && len(is.m) >= INFO_MAX {
+			is.evict()
+		}
+		i = &nsInfo{srtt: RTT_UNKNOWN, lame: make(map[string]time.Time)}
+		is.m[addr] = i
+	}
+	i.updated = time.Now()
+	return i
+}
+
+// evict makes room for a new entry: idle entries among a few random samples are
+// dropped, or the least recently updated one if all of them are still in use.
+// Must be called with the lock held.
+func (is *infoStore) evict() {
+	victim := ""
+	var oldest time.Time
+	n := 0
+	for addr, i := range is.m {
+		if time.Since(i.updated) > INFO_LIFETIME {
+			delete(is.m, addr)
+		} else if victim == "" || i.updated.Before(oldest) {
+			victim = addr
+			oldest = i.updated
+		}
+		if n++; n == INFO_SAMPLES {
+			break
+		}
+	}
+	if len(is.m) >= INFO_MAX {
+		delete(is.m, victim)
+	}
+}
+
+// recordRtt updates the smoothed RTT of addr after receiving a reply (RFC 6298 2)
+func (is *infoStore) recordRtt(addr *net.UDPAddr, rtt time.Duration) {
+	is.Lock()
+	defer is.Unlock()
+	i := is.get(addr.String())
+	if i.timeouts > 0 || i.srtt == RTT_UNKNOWN {
+		i.srtt = rtt
+	} else {
+		i.srtt = (7*i.srtt + rtt) / 8
+	}
+	i.timeouts = 0
+}
+
+// recordTimeout penalizes addr for not replying in time
+func (is *infoStore) recordTimeout(addr string) {
+	is.Lock()
+	defer is.Unlock()
+	i := is.get(addr)
+	i.timeouts++
+	i.srtt *= 2
+	if i.srtt > RTT_MAX {
+		i.srtt = RTT_MAX
+	}
+}
+
+// recordLame marks addr as being unable to serve zone
+func (is *infoStore) recordLame(addr *net.UDPAddr, zone *packet.Namelabel) {
+	is.Lock()
+	defer is.Unlock()
+	is.get(addr.String()).lame[zone.ToKey()] = time.Now().Add(INFO_LIFETIME)
+}
+
+// recordCaseMismatch notes that addr replied with a question whose case differed from what we sent
+func (is *infoStore) recordCaseMismatch(addr string) {
+	is.Lock()
+	defer is.Unlock()
+	is.get(addr).caseMiss++
+}
+
+// preservesCase returns false if addr is known to mangle the case
+// of questions, so we must not use 0x20 randomization with it
+func (is *infoStore) preservesCase(addr string) bool {
+	is.Lock()
+	defer is.Unlock()
+	i := is.m[addr]
+	return i == nil || time.Since(i.updated) > INFO_LIFETIME || i.caseMiss < CASE_MISSES
+}
+
+// score returns the expected response time of addr for zone. Must be called with the lock held.
+func (is *infoStore) score(addr string, zone *packet.Namelabel) time.Duration {
+	i := is.m[addr]
+	if i == nil || time.Since(i.updated) > INFO_LIFETIME {
+		return RTT_UNKNOWN
+	}
+	if deadline, ok := i.lame[zone.ToKey()]; ok && time.Now().Before(deadline) {
+		return RTT_LAME
+	}
+	return i.srtt
+}
+
+// pick returns the best candidate to query zone. Addresses in tried are
+// skipped, unless there is nothing else left, in which case fresh is false.
+func (is *infoStore) pick(candidates []nsCandidate, zone *packet.Namelabel, tried map[string]bool) (addr string, fresh bool) {
+	is.Lock()
+	defer is.Unlock()
+
+	var best time.Duration
+	for _, wantFresh := range []bool{true, false} {
+		for _, c := range candidates {
+			if tried[c.addr] == wantFresh {
+				continue
+			}
+			// prefer the configured address family and add some jitter
+			// to spread the load between servers of similar speed
+			s := is.score(c.addr, zone) + time.Duration(c.rank)*RTT_UNKNOWN/4 + time.Duration(rand.Int63n(int64(5*time.Millisecond)))
+			if addr == "" || s < best {
+				addr = c.addr
+				best = s
+			}
+		}
+		if addr != "" {
+			return addr, wantFresh
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,32 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInfoStoreLimit(t *testing.T) {
+	is := newInfoStore()
+	is.Lock()
+	defer is.Unlock()
+
+	for i := 0; i < INFO_MAX+100; i++ {
+		is.get(fmt.Sprintf("192.0.2.%d:%d", i%256, i))
+	}
+	if len(is.m) != INFO_MAX {
+		panic(fmt.Errorf("Expected %d tracked addresses, got %d", INFO_MAX, len(is.m)))
+	}
+
+	// idle entries are dropped first
+	for _, i := range is.m {
+		i.updated = time.Now().Add(-2 * INFO_LIFETIME)
+	}
+	is.get("198.51.100.1:53")
+	if len(is.m) >= INFO_MAX {
+		panic(fmt.Errorf("Idle entries were not dropped, still tracking %d addresses", len(is.m)))
+	}
+	if is.m["198.51.100.1:53"] == nil {
+		panic(fmt.Errorf("New address is not tracked"))
+	}
+}
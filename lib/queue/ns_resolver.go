@@ -0,0 +1,94 @@
+package queue
+
+import (
+	l "github.com/adrian-bl/rna/lib/log"
+	"github.com/adrian-bl/rna/lib/packet"
+)
+
+// Max. number of concurrent address lookups for the nameservers of a single zone
+const MAX_NS_LOOKUPS = 4
+
+// nsLookup is a running address lookup of a nameserver name
+type nsLookup struct {
+	owner  *queryBudget  // budget of the query which started the lookup
+	done   chan bool     // closed once the lookup finished
+	result []nsCandidate // valid after done was closed
+}
+
+// resolveNsAddresses looks up the addresses of all nameservers in names,
+// running at most MAX_NS_LOOKUPS lookups at the same time. Each finished
+// lookup sends its candidates to the returned channel, which is closed after
+// all lookups finished. Callers may stop reading at any time.
+// Names which are already being looked up by another query are awaited,
+// names looked up by a sub-lookup of the same query are skipped to avoid loops.
+func (cq *Cq) resolveNsAddresses(names []packet.Namelabel, qctx *qCtx) <-chan []nsCandidate {
+	found := make(chan []nsCandidate, len(names)) // buffered: nobody might be listening
+	slots := make(chan bool, MAX_NS_LOOKUPS)
+
+	pending := make([]packet.Namelabel, 0)
+	awaiting := make([]*nsLookup, 0)
+	cq.Lock()
+	for _, name := range names {
+		if lk := cq.nsLookups[name.ToKey()]; lk == nil {
+			cq.nsLookups[name.ToKey()] = &nsLookup{owner: qctx.budget, done: make(chan bool)}
+			pending = append(pending, name)
+		} else if lk.owner != qctx.budget {
+			awaiting = append(awaiting, lk)
+		}
+	}
+	cq.Unlock()
+
+	go func() {
+		done := make(chan bool)
+		for _, lk := range awaiting {
+			go func(lk *nsLookup) {
+				select {
+				case <-lk.done:
+					found <- lk.result
+				case <-qctx.context.Done():
+				}
+				done <- true
+			}(lk)
+		}
+		for _, name := range pending {
+			slots <- true
+			go func(name packet.Namelabel) {
+				found <- cq.resolveNsAddress(name, qctx)
+				<-slots
+				done <- true
+			}(name)
+		}
+		for i := 0; i < len(pending)+len(awaiting); i++ {
+			<-done
+		}
+		close(found)
+	}()
+	return found
+}
+
+// resolveNsAddress looks up the address of nameserver name, trying all configured address families
+func (cq *Cq) resolveNsAddress(name packet.Namelabel, qctx *qCtx) (result []nsCandidate) {
+	defer func() {
+		cq.finishNsLookup(name.ToKey(), result)
+	}()
+
+	l.Debug("Looking up IP of known candidate: %v", name)
+	for rank, t := range cq.nsAddressTypes() {
+		lres := cq.resolve(name, t, qctx)
+		if lres != nil && lres.status == LR_POSITIVE {
+			return addressCandidates(lres.cres, rank)
+		}
+	}
+	return nil
+}
+
+// finishNsLookup publishes the result of the lookup of key to everyone waiting for it
+func (cq *Cq) finishNsLookup(key string, result []nsCandidate) {
+	cq.Lock()
+	defer cq.Unlock()
+	if lk := cq.nsLookups[key]; lk != nil {
+		delete(cq.nsLookups, key)
+		lk.result = result
+		close(lk.done)
+	}
+}
@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/packet"
+	"testing"
+	"time"
+)
+
+func nsTestQueue() *Cq {
+	c := cache.NewNameCache()
+	return NewClientQueue(c, NewServerQueue(c))
+}
+
+func TestAwaitNsLookup(t *testing.T) {
+	cq := nsTestQueue()
+	name, _ := packet.ParseTextName("ns1.example")
+	names := []packet.Namelabel{name}
+
+	// the first query starts looking up ns1.example
+	first := newQCtx(time.Now().Add(time.Minute))
+	cq.nsLookups[name.ToKey()] = &nsLookup{owner: first.budget, done: make(chan bool)}
+
+	// its own sub-lookups must not wait for it
+	if _, open := <-cq.resolveNsAddresses(names, first); open {
+		panic(fmt.Errorf("Sub-lookup returned candidates of its own running lookup"))
+	}
+
+	// a second query for the same delegation waits for the result
+	second := newQCtx(time.Now().Add(time.Minute))
+	found := cq.resolveNsAddresses(names, second)
+	select {
+	case <-found:
+		panic(fmt.Errorf("Second query did not wait for the running lookup"))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cq.finishNsLookup(name.ToKey(), []nsCandidate{{addr: "192.0.2.1:53"}})
+	if c := <-found; len(c) != 1 || c[0].addr != "192.0.2.1:53" {
+		panic(fmt.Errorf("Second query got the wrong candidates: %+v", c))
+	}
+	if _, open := <-found; open {
+		panic(fmt.Errorf("Channel was not closed after all lookups finished"))
+	}
+	if len(cq.nsLookups) != 0 {
+		panic(fmt.Errorf("Finished lookup was not removed: %+v", cq.nsLookups))
+	}
+}
+
+func TestAwaitNsLookupTimeout(t *testing.T) {
+	cq := nsTestQueue()
+	name, _ := packet.ParseTextName("ns1.example")
+
+	first := newQCtx(time.Now().Add(time.Minute))
+	cq.nsLookups[name.ToKey()] = &nsLookup{owner: first.budget, done: make(chan bool)}
+
+	// waiting ends with the context of the waiting query
+	second := newQCtx(time.Now().Add(50 * time.Millisecond))
+	if _, open := <-cq.resolveNsAddresses([]packet.Namelabel{name}, second); open {
+		panic(fmt.Errorf("Expired query got candidates"))
+	}
+}
@@ -0,0 +1,75 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/hints"
+	l "github.com/adrian-bl/rna/lib/log"
+	"github.com/adrian-bl/rna/lib/packet"
+	"net"
+	"time"
+)
+
+// SetRootHints configures the root servers used to prime the cache
+func (cq *Cq) SetRootHints(rrs []packet.ResourceRecordFormat) {
+	cq.rootHints = hints.Addresses(rrs)
+}
+
+// rootHintCandidates returns the addresses of all root servers. All
+// hints are used if none of them matches the configured address family
+func (cq *Cq) rootHintCandidates() []nsCandidate {
+	candidates := make([]nsCandidate, 0)
+	for rank, t := range cq.nsAddressTypes() {
+		for _, ip := range cq.rootHints {
+			if (ip.To4() != nil) == (t == constants.TYPE_A) {
+				candidates = append(candidates, nsCandidate{addr: net.JoinHostPort(ip.String(), "53"), rank: rank})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		for _, ip := range cq.rootHints {
+			candidates = append(candidates, nsCandidate{addr: net.JoinHostPort(ip.String(), "53")})
+		}
+	}
+	return candidates
+}
+
+// StartPriming queries the NS set of the root zone using the root hints
+// and re-primes the cache as soon as the cached set expires (RFC 8109)
+func (cq *Cq) StartPriming() {
+	go func() {
+		for {
+			wait := constants.TIMEOUT_PRIME_RETRY
+			ttl, err := cq.primeRoot()
+			if err == nil {
+				// wait for the cached set to expire, so the next run hits the network
+				wait = time.Duration(ttl)*time.Second + time.Second
+			} else {
+				l.Info("Priming failed: %v", err)
+			}
+			time.Sleep(wait)
+		}
+	}()
+}
+
+// primeRoot resolves the NS set of the root zone and
+// returns the remaining TTL of the cached set
+func (cq *Cq) primeRoot() (uint32, error) {
+	qctx := newQCtx(time.Now().Add(constants.TIMEOUT_LOOKUP))
+	defer qctx.cancel()
+
+	root, _ := packet.ParseTextName(".")
+	lres := cq.resolve(root, constants.TYPE_NS, qctx)
+	if lres == nil || lres.status != LR_POSITIVE || len(lres.cres.ResourceRecord) == 0 {
+		return 0, fmt.Errorf("no NS records for the root zone")
+	}
+
+	ttl := constants.MAX_VALUE_TTL
+	for _, rr := range lres.cres.ResourceRecord {
+		if rr.Ttl < ttl {
+			ttl = rr.Ttl
+		}
+	}
+	l.Info("Primed root zone with %d nameservers, ttl=%d", len(lres.cres.ResourceRecord), ttl)
+	return ttl, nil
+}
@@ -1,43 +1,152 @@
 package queue
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
 	"github.com/adrian-bl/rna/lib/constants"
 	l "github.com/adrian-bl/rna/lib/log"
 	"github.com/adrian-bl/rna/lib/packet"
 	"net"
+	"time"
 )
 
-func (cq *Cq) newServerReader() (*net.UDPConn, error) {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+const (
+	PORT_MIN   = 1024 // lowest source port used for upstream queries
+	PORT_TRIES = 10   // attempts to bind a random source port before letting the OS pick one
+)
+
+// sendUdpQuery sends pp to ns using a new socket bound to a random source port.
+// The socket accepts a single reply, which must match the ID, address and
+// question of pp. Everything else is counted as a possible spoofing attempt.
+func (cq *Cq) sendUdpQuery(pp *packet.ParsedPacket, ns *net.UDPAddr, label *packet.Namelabel, forwarder bool, qctx *qCtx) error {
+	conn, err := listenRandomPort()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	go func() {
-		buf := make([]byte, constants.MAX_SIZE_UDP)
-		for {
-			nread, remoteAddr, err := conn.ReadFromUDP(buf)
-			if err != nil || nread == 0 {
-				l.Debug("Shutdown due to closed sock with err %v", err)
-				break
-			}
-			if nread < constants.FIX_SIZE_HEADER {
-				l.Debug("Short read: %d\n", nread)
-				continue
-			}
+	cq.sq.registerQuery(pp.Questions[0], ns, label, forwarder)
+	if _, err := conn.WriteToUDP(packet.Assemble(pp), ns); err != nil {
+		conn.Close()
+		return err
+	}
+
+	go cq.readUdpReply(conn, pp, ns, qctx)
+	return nil
+}
+
+// readUdpReply waits for the reply to pp on conn and closes the socket afterwards
+func (cq *Cq) readUdpReply(conn *net.UDPConn, pp *packet.ParsedPacket, ns *net.UDPAddr, qctx *qCtx) {
+	defer conn.Close()
 
-			p, err := packet.Parse(buf[0:nread])
-			if err != nil {
-				l.Debug("%v failed to parse datagram, err=%v", remoteAddr, err)
-				continue
+	deadline := time.Now().Add(constants.TIMEOUT_UDP_UPSTREAM)
+	shortened := false // the client gave up before the server had its full time to reply
+	if d, ok := qctx.context.Deadline(); ok && d.Before(deadline) {
+		deadline, shortened = d, true
+	}
+	conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, cq.ednsSize) // we never advertise more than this
+	for {
+		nread, remoteAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			l.Debug("giving up on reply from %v: %v", ns, err)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && !shortened {
+				cq.sq.infos.recordTimeout(ns.String())
 			}
-			if p.Header.Response == true && p.Header.Opcode == constants.OP_QUERY {
-				cq.cache.Put(p, remoteAddr)
-			} else {
-				l.Debug("??? %v dropped strange packet", remoteAddr)
+			return
+		}
+		if nread < constants.FIX_SIZE_HEADER {
+			l.Debug("Short read: %d\n", nread)
+			continue
+		}
+
+		p, err := packet.Parse(buf[0:nread])
+		if err != nil {
+			l.Debug("%v failed to parse datagram, err=%v", remoteAddr, err)
+			continue
+		}
+		if reason := replyMismatch(pp, p, ns, remoteAddr); reason != "" {
+			cq.sq.recordMismatch(remoteAddr, reason)
+			continue
+		}
+
+		if p.Header.Truncated == true {
+			// Partial reply: do not cache anything but re-do the query via TCP
+			go cq.tcpQuery(pp.Questions[0], pp.Header.RecDesired, ns, qctx)
+		} else if isLameReply(p) {
+			l.Debug("%v sent a lame reply, rcode=%d", ns, p.Header.ResponseCode)
+			if cq.sq.handleLameReply(p.Questions[0], ns) {
+				cq.handleFailCallback(p.Questions[0])
 			}
+		} else {
+			cq.cache.Put(p, ns)
 		}
-	}()
+		return
+	}
+}
+
+// replyMismatch returns why p, received from remote, is not a valid reply to
+// query pp sent to ns, or an empty string if it is. The case of the question
+// is checked by the server queue, as some servers do not preserve it.
+func replyMismatch(pp *packet.ParsedPacket, p *packet.ParsedPacket, ns *net.UDPAddr, remote *net.UDPAddr) string {
+	q := pp.Questions[0]
+	switch {
+	case !remote.IP.Equal(ns.IP) || remote.Port != ns.Port:
+		return fmt.Sprintf("reply for %v sent by wrong address", ns)
+	case p.Header.Response == false || p.Header.Opcode != constants.OP_QUERY:
+		return "not a reply to a query"
+	case p.Header.Id != pp.Header.Id:
+		return fmt.Sprintf("id %d does not match %d", p.Header.Id, pp.Header.Id)
+	case len(p.Questions) != 1:
+		return fmt.Sprintf("reply has %d questions", len(p.Questions))
+	case p.Questions[0].Name.ToKey() != q.Name.ToKey() || p.Questions[0].Type != q.Type || p.Questions[0].Class != q.Class:
+		return fmt.Sprintf("question %v does not match %v", p.Questions[0].Name, q.Name)
+	}
+	return ""
+}
+
+// listenRandomPort returns a dual-stack socket, able to talk to
+// IPv4 and IPv6 nameservers, bound to a random port
+func listenRandomPort() (*net.UDPConn, error) {
+	for i := 0; i < PORT_TRIES; i++ {
+		port := PORT_MIN + int(randomUint16())%(0x10000-PORT_MIN)
+		if conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port}); err == nil {
+			return conn, nil
+		}
+	}
+	return net.ListenUDP("udp", &net.UDPAddr{})
+}
+
+// randomUint16 returns a random value from a CSPRNG,
+// used for query IDs and source ports
+func randomUint16() uint16 {
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return binary.BigEndian.Uint16(b)
+}
 
-	return conn, nil
+// isLameReply returns true if p indicates that the server is unable
+// to answer the question: either by returning an error or by replying
+// without being authoritative, referring us elsewhere or denying the name
+func isLameReply(p *packet.ParsedPacket) bool {
+	if len(p.Questions) != 1 {
+		return false
+	}
+	switch p.Header.ResponseCode {
+	case constants.RC_SERV_FAIL, constants.RC_NOT_IMPL, constants.RC_REFUSED:
+		return true
+	case constants.RC_NO_ERR:
+		if p.Header.Authoritative == false && len(p.Answers) == 0 {
+			for _, rr := range p.Nameservers {
+				if rr.Type == constants.TYPE_NS || rr.Type == constants.TYPE_SOA {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
 }
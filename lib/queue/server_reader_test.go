@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+// readerTestQuery returns a query for name
+func readerTestQuery(name string) *packet.ParsedPacket {
+	label, _ := packet.ParseTextName(name)
+	pp := &packet.ParsedPacket{}
+	pp.Header.Id = 4711
+	pp.Header.Opcode = constants.OP_QUERY
+	pp.Header.QuestionCount = 1
+	pp.Questions = []packet.QuestionFormat{{Name: label, Class: constants.CLASS_IN, Type: constants.TYPE_A}}
+	return pp
+}
+
+// readerTestReply returns an authoritative reply to pp
+func readerTestReply(pp *packet.ParsedPacket, ip net.IP) *packet.ParsedPacket {
+	p := &packet.ParsedPacket{Header: pp.Header, Questions: pp.Questions}
+	p.Header.Response = true
+	p.Header.Authoritative = true
+	p.Header.AnswerCount = 1
+	p.Answers = []packet.ResourceRecordFormat{{Name: pp.Questions[0].Name, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 300, Data: ip.To4()}}
+	return p
+}
+
+func TestReplyMismatch(t *testing.T) {
+	ns := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	pp := readerTestQuery("www.example")
+
+	if reason := replyMismatch(pp, readerTestReply(pp, net.IPv4(192, 0, 2, 80)), ns, ns); reason != "" {
+		panic(fmt.Errorf("Valid reply was rejected: %s", reason))
+	}
+
+	spoofed := readerTestReply(pp, net.IPv4(192, 0, 2, 66))
+	spoofed.Header.Id++
+	if replyMismatch(pp, spoofed, ns, ns) == "" {
+		panic(fmt.Errorf("Accepted a reply with a spoofed ID"))
+	}
+
+	for _, remote := range []*net.UDPAddr{{IP: net.ParseIP("192.0.2.2"), Port: 53}, {IP: net.ParseIP("192.0.2.1"), Port: 5353}} {
+		if replyMismatch(pp, readerTestReply(pp, net.IPv4(192, 0, 2, 66)), ns, remote) == "" {
+			panic(fmt.Errorf("Accepted a reply sent by %v", remote))
+		}
+	}
+
+	query := readerTestReply(pp, net.IPv4(192, 0, 2, 66))
+	query.Header.Response = false
+	if replyMismatch(pp, query, ns, ns) == "" {
+		panic(fmt.Errorf("Accepted a query as reply"))
+	}
+
+	other := readerTestReply(readerTestQuery("www.example.net"), net.IPv4(192, 0, 2, 66))
+	other.Header.Id = pp.Header.Id
+	if replyMismatch(pp, other, ns, ns) == "" {
+		panic(fmt.Errorf("Accepted a reply for another question"))
+	}
+}
+
+func TestReadUdpReply(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Close()
+	spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		panic(err)
+	}
+	defer spoofer.Close()
+
+	c := cache.NewNameCache()
+	sq := NewServerQueue(c)
+	cq := NewClientQueue(c, sq)
+	pp := readerTestQuery("www.example")
+	root, _ := packet.ParseTextName(".")
+	ns := server.LocalAddr().(*net.UDPAddr)
+	if err := cq.sendUdpQuery(pp, ns, &root, false, newQCtx(time.Now().Add(time.Minute))); err != nil {
+		panic(err)
+	}
+
+	buf := make([]byte, constants.MAX_SIZE_UDP)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, client, err := server.ReadFromUDP(buf)
+	if err != nil {
+		panic(err)
+	}
+
+	// a reply with a wrong ID and one sent from a wrong port are ignored...
+	spoofed := readerTestReply(pp, net.IPv4(192, 0, 2, 66))
+	spoofed.Header.Id++
+	server.WriteToUDP(packet.Assemble(spoofed), client)
+	spoofer.WriteToUDP(packet.Assemble(readerTestReply(pp, net.IPv4(192, 0, 2, 66))), client)
+	// ...while waiting for the real one
+	server.WriteToUDP(packet.Assemble(readerTestReply(pp, net.IPv4(192, 0, 2, 80))), client)
+
+	for i := 0; i < 100 && sq.Stats().Pending != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cres, _ := c.Lookup(pp.Questions[0].Name, constants.TYPE_A)
+	if cres == nil || len(cres.ResourceRecord) != 1 || !net.IP(cres.ResourceRecord[0].Data).Equal(net.IPv4(192, 0, 2, 80)) {
+		panic(fmt.Errorf("Expected the real reply to be cached, got %+v", cres))
+	}
+	if st := sq.Stats(); st.Mismatches != 2 || st.Pending != 0 {
+		panic(fmt.Errorf("Expected 2 mismatching replies and no pending query, got %+v", st))
+	}
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"github.com/adrian-bl/rna/lib/constants"
+	l "github.com/adrian-bl/rna/lib/log"
+	"github.com/adrian-bl/rna/lib/packet"
+	"net"
+	"time"
+)
+
+// tcpQuery re-sends question q to ns using TCP and injects the reply
+// into the cache. This is used to retry queries whose UDP reply had
+// the TC bit set. The question is sent as-is, so it must match
+// what was registered in the server queue. rd is set for forwarders.
+func (cq *Cq) tcpQuery(q packet.QuestionFormat, rd bool, ns *net.UDPAddr, qctx *qCtx) {
+	d := &net.Dialer{Timeout: constants.TIMEOUT_TCP_UPSTREAM}
+	conn, err := d.DialContext(qctx.context, "tcp", ns.String())
+	if err != nil {
+		l.Debug("tcp connection to %v failed: %v", ns, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(constants.TIMEOUT_TCP_UPSTREAM))
+
+	pp := &packet.ParsedPacket{}
+	pp.Header.Id = randomUint16()
+	pp.Header.Opcode = constants.OP_QUERY
+	pp.Header.RecDesired = rd
+	pp.Questions = []packet.QuestionFormat{q}
+	pp.Edns = &packet.EdnsOpt{UdpSize: cq.ednsSize, DnssecOk: cq.validate}
+
+	l.Info("+ op=query, proto=tcp, remote=%v, type=%d, id=%d, name=%v", ns, q.Type, pp.Header.Id, q.Name)
+	if err := packet.WriteTcpFrame(conn, packet.Assemble(pp)); err != nil {
+		l.Debug("tcp write to %v failed: %v", ns, err)
+		return
+	}
+
+	buf, err := packet.ReadTcpFrame(conn)
+	if err != nil {
+		l.Debug("tcp read from %v failed: %v", ns, err)
+		return
+	}
+
+	p, err := packet.Parse(buf)
+	if err != nil {
+		l.Debug("%v failed to parse tcp reply, err=%v", ns, err)
+		return
+	}
+	if p.Header.Response == false || p.Header.Id != pp.Header.Id {
+		l.Debug("??? %v dropped unexpected tcp reply", ns)
+		return
+	}
+	cq.cache.Put(p, ns)
+}
@@ -1,26 +1,53 @@
 package queue
 
 import (
+	"container/list"
 	"fmt"
 	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/constants"
+	l "github.com/adrian-bl/rna/lib/log"
 	"github.com/adrian-bl/rna/lib/packet"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SQ_MAX_ENTRIES   = 10000                                                           // max. number of outstanding queries
+	SQ_ENTRY_TIMEOUT = constants.TIMEOUT_UDP_UPSTREAM + constants.TIMEOUT_TCP_UPSTREAM // replies may still arrive via TCP after a truncated UDP reply
 )
 
 type SqEntry struct {
-	key     string
+	key     string // case insensitive key of the question and server
+	name    string // case sensitive key of the name we sent
 	xhlabel *packet.Namelabel
+	fwd     bool // `true' if the query was sent to a forwarder
+	sent    time.Time
 }
 
+// Sq keeps track of all queries sent to upstream servers,
+// so we only accept replies we actually asked for
 type Sq struct {
 	sync.Mutex
-	q [200]SqEntry // keep up to 200 outstanding replies
-	c int          // cursor
+	pending    map[string][]*list.Element // outstanding queries by key, oldest first
+	order      *list.List                 // all outstanding *SqEntry items, oldest first
+	infos      *infoStore                 // what we know about upstream servers
+	mismatches uint64                     // replies not matching any query, accessed atomically
+	expired    uint64                     // entries removed because they timed out
+	evicted    uint64                     // entries removed because the table was full
+}
+
+// Statistics about the server queue
+type SqStats struct {
+	Pending    int
+	Expired    uint64
+	Evicted    uint64
+	Mismatches uint64
 }
 
 func NewServerQueue(nc *cache.Cache) *Sq {
-	sq := &Sq{}
+	sq := &Sq{pending: make(map[string][]*list.Element), order: list.New(), infos: newInfoStore()}
 	nc.RegisterVeritfyCallback(sq.handleVerifyCallback)
 	return sq
 }
@@ -28,30 +55,113 @@ func NewServerQueue(nc *cache.Cache) *Sq {
 // registerQuery registers that we sent given question for given label to the specified IP
 // you are then supposed to call handleVerifyCallback() to verify that an incoming reply
 // was actually requested
-func (sq *Sq) registerQuery(q packet.QuestionFormat, ns *net.UDPAddr, label *packet.Namelabel) {
+func (sq *Sq) registerQuery(q packet.QuestionFormat, ns *net.UDPAddr, label *packet.Namelabel, forwarder bool) {
+	e := &SqEntry{key: sq.toKey(q, ns), name: q.Name.ToCaseSensitiveKey(), xhlabel: label, fwd: forwarder, sent: time.Now()}
+
 	sq.Lock()
-	sq.q[sq.c] = SqEntry{key: sq.toKey(q, ns), xhlabel: label}
-	sq.Unlock()
-	sq.c++
-	if sq.c == len(sq.q) {
-		sq.c = 0
+	defer sq.Unlock()
+	sq.expireEntries(e.sent)
+	if sq.order.Len() >= SQ_MAX_ENTRIES {
+		sq.removeElement(sq.order.Front())
+		sq.evicted++
+		l.Info("server queue is full, dropped the oldest outstanding query")
+	}
+	sq.pending[e.key] = append(sq.pending[e.key], sq.order.PushBack(e))
+}
+
+// expireEntries removes all entries which timed out at now. Must be called locked.
+func (sq *Sq) expireEntries(now time.Time) {
+	for el := sq.order.Front(); el != nil && now.Sub(el.Value.(*SqEntry).sent) > SQ_ENTRY_TIMEOUT; el = sq.order.Front() {
+		sq.removeElement(el)
+		sq.expired++
+	}
+}
+
+// removeElement removes el from the queue. Must be called locked.
+func (sq *Sq) removeElement(el *list.Element) {
+	e := sq.order.Remove(el).(*SqEntry)
+	elements := sq.pending[e.key]
+	for i, v := range elements {
+		if v == el {
+			elements = append(elements[:i], elements[i+1:]...)
+			break
+		}
+	}
+	if len(elements) == 0 {
+		delete(sq.pending, e.key)
+	} else {
+		sq.pending[e.key] = elements
 	}
 }
 
-// returns the namelabel (if any) wich was registered via registerQuery() for given question
-func (sq *Sq) handleVerifyCallback(q packet.QuestionFormat, ns *net.UDPAddr) *packet.Namelabel {
+// Stats returns statistics about the outstanding queries
+func (sq *Sq) Stats() SqStats {
+	sq.Lock()
+	defer sq.Unlock()
+	return SqStats{Pending: sq.order.Len(), Expired: sq.expired, Evicted: sq.evicted, Mismatches: atomic.LoadUint64(&sq.mismatches)}
+}
+
+// returns the origin (if any) wich was registered via registerQuery() for given question
+func (sq *Sq) handleVerifyCallback(q packet.QuestionFormat, ns *net.UDPAddr) *cache.ReplyOrigin {
+	e := sq.popEntry(q, ns)
+	if e == nil {
+		return nil
+	}
+	sq.infos.recordRtt(ns, time.Since(e.sent))
+	return &cache.ReplyOrigin{Zone: e.xhlabel, Forwarder: e.fwd}
+}
+
+// handleLameReply consumes the query registered for q and marks ns as lame
+// for the zone it was asked about. Returns false if the reply was unexpected.
+func (sq *Sq) handleLameReply(q packet.QuestionFormat, ns *net.UDPAddr) bool {
+	e := sq.popEntry(q, ns)
+	if e == nil {
+		return false
+	}
+	sq.infos.recordLame(ns, e.xhlabel)
+	return true
+}
+
+// popEntry removes and returns the entry registered for given question and server.
+// The name must match the case we used in the query, unless the server is known
+// to not preserve it. Mismatches keep the entry, as the reply might have been forged.
+func (sq *Sq) popEntry(q packet.QuestionFormat, ns *net.UDPAddr) *SqEntry {
 	key := sq.toKey(q, ns)
+	name := q.Name.ToCaseSensitiveKey()
+
 	sq.Lock()
 	defer sq.Unlock()
-	for i, e := range sq.q {
-		if e.key == key {
-			sq.q[i] = SqEntry{}
-			return e.xhlabel
+	sq.expireEntries(time.Now())
+
+	elements := sq.pending[key]
+	if len(elements) == 0 {
+		return nil
+	}
+	match := elements[0]
+	for _, el := range elements {
+		if el.Value.(*SqEntry).name == name {
+			match = el
+			break
 		}
 	}
-	return nil
+
+	e := match.Value.(*SqEntry)
+	if e.name != name && sq.infos.preservesCase(ns.String()) {
+		sq.infos.recordCaseMismatch(ns.String())
+		sq.recordMismatch(ns, fmt.Sprintf("case of %v does not match", q.Name))
+		return nil
+	}
+	sq.removeElement(match)
+	return e
+}
+
+// recordMismatch counts a reply from remote which did not match
+// the query it claims to answer: this might be a spoofing attempt
+func (sq *Sq) recordMismatch(remote *net.UDPAddr, reason string) {
+	n := atomic.AddUint64(&sq.mismatches, 1)
+	l.Info("possible spoofing attempt #%d from %v: %s", n, remote, reason)
 }
 
 func (sq *Sq) toKey(q packet.QuestionFormat, ns *net.UDPAddr) string {
-	return fmt.Sprintf("ns=%s, q=%s, t=%d, c=%d ", ns, q.Name.ToCaseSensitiveKey(), q.Type, q.Class)
+	return fmt.Sprintf("ns=%s, q=%s, t=%d, c=%d ", ns, q.Name.ToKey(), q.Type, q.Class)
 }
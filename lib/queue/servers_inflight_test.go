@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+var sqTestNs = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+
+// sqTestQuestion returns an A question for name
+func sqTestQuestion(name string) packet.QuestionFormat {
+	label, _ := packet.ParseTextName(name)
+	return packet.QuestionFormat{Name: label, Class: constants.CLASS_IN, Type: constants.TYPE_A}
+}
+
+func sqTestQueue() *Sq {
+	return NewServerQueue(cache.NewNameCache())
+}
+
+func TestSqMatch(t *testing.T) {
+	sq := sqTestQueue()
+	root, _ := packet.ParseTextName(".")
+	sq.registerQuery(sqTestQuestion("www.example"), sqTestNs, &root, false)
+
+	if sq.popEntry(sqTestQuestion("www.example"), &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}) != nil {
+		panic(fmt.Errorf("Matched a reply from another server"))
+	}
+	if sq.popEntry(sqTestQuestion("ftp.example"), sqTestNs) != nil {
+		panic(fmt.Errorf("Matched a reply for another question"))
+	}
+	if sq.popEntry(sqTestQuestion("www.example"), sqTestNs) == nil {
+		panic(fmt.Errorf("Did not match the registered query"))
+	}
+	if sq.popEntry(sqTestQuestion("www.example"), sqTestNs) != nil {
+		panic(fmt.Errorf("Matched the same query twice"))
+	}
+}
+
+func TestSqCaseMismatch(t *testing.T) {
+	sq := sqTestQueue()
+	root, _ := packet.ParseTextName(".")
+
+	for i := 0; i < CASE_MISSES; i++ {
+		sq.registerQuery(sqTestQuestion("wWw.ExAmple"), sqTestNs, &root, false)
+		if sq.popEntry(sqTestQuestion("www.example"), sqTestNs) != nil {
+			panic(fmt.Errorf("Accepted a reply with a mismatching case"))
+		}
+		// the entry is kept: the real reply may still arrive
+		if sq.popEntry(sqTestQuestion("wWw.ExAmple"), sqTestNs) == nil {
+			panic(fmt.Errorf("Rejected the real reply after a mismatching one"))
+		}
+	}
+	if st := sq.Stats(); st.Mismatches != CASE_MISSES {
+		panic(fmt.Errorf("Expected %d mismatches, got %+v", CASE_MISSES, st))
+	}
+
+	// the server does not preserve the case: stop being picky
+	sq.registerQuery(sqTestQuestion("wWw.ExAmple"), sqTestNs, &root, false)
+	if sq.popEntry(sqTestQuestion("www.example"), sqTestNs) == nil {
+		panic(fmt.Errorf("Rejected a reply from a server known to not preserve the case"))
+	}
+}
+
+func TestSqFull(t *testing.T) {
+	sq := sqTestQueue()
+	root, _ := packet.ParseTextName(".")
+	for i := 0; i <= SQ_MAX_ENTRIES; i++ {
+		sq.registerQuery(sqTestQuestion(fmt.Sprintf("host%d.example", i)), sqTestNs, &root, false)
+	}
+	if st := sq.Stats(); st.Pending != SQ_MAX_ENTRIES || st.Evicted != 1 {
+		panic(fmt.Errorf("Expected %d pending and 1 evicted query, got %+v", SQ_MAX_ENTRIES, st))
+	}
+	if sq.popEntry(sqTestQuestion("host0.example"), sqTestNs) != nil {
+		panic(fmt.Errorf("Oldest query was not evicted"))
+	}
+
+	// replies are matched by key, not by walking the whole table
+	if len(sq.pending) != SQ_MAX_ENTRIES {
+		panic(fmt.Errorf("Expected %d keys, got %d", SQ_MAX_ENTRIES, len(sq.pending)))
+	}
+	for i := 1; i <= SQ_MAX_ENTRIES; i++ {
+		q := sqTestQuestion(fmt.Sprintf("host%d.example", i))
+		if len(sq.pending[sq.toKey(q, sqTestNs)]) != 1 || sq.popEntry(q, sqTestNs) == nil {
+			panic(fmt.Errorf("Query %d was not matched", i))
+		}
+	}
+	if st := sq.Stats(); st.Pending != 0 || len(sq.pending) != 0 {
+		panic(fmt.Errorf("Expected an empty table, got %+v", st))
+	}
+}
+
+func TestSqExpire(t *testing.T) {
+	sq := sqTestQueue()
+	root, _ := packet.ParseTextName(".")
+	sq.registerQuery(sqTestQuestion("old.example"), sqTestNs, &root, false)
+	sq.registerQuery(sqTestQuestion("new.example"), sqTestNs, &root, false)
+	sq.order.Front().Value.(*SqEntry).sent = time.Now().Add(-SQ_ENTRY_TIMEOUT - time.Second)
+
+	if sq.popEntry(sqTestQuestion("old.example"), sqTestNs) != nil {
+		panic(fmt.Errorf("Matched an expired query"))
+	}
+	if sq.popEntry(sqTestQuestion("new.example"), sqTestNs) == nil {
+		panic(fmt.Errorf("Did not match a query which did not expire"))
+	}
+	if st := sq.Stats(); st.Expired != 1 || st.Pending != 0 {
+		panic(fmt.Errorf("Expected 1 expired query, got %+v", st))
+	}
+}
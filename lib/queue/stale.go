@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"time"
+)
+
+// staleTimer returns a channel receiving a value once the client response
+// timer of RFC 8767 expired, or nil if we do not serve stale data
+func (cq *Cq) staleTimer() <-chan time.Time {
+	if cq.cache.StaleWindow() == 0 {
+		return nil
+	}
+	return time.After(constants.TIMEOUT_STALE_ANSWER)
+}
+
+// staleResult answers the query of cr from the cache, including expired data
+// and following CNAMEs. Stale data is not validated again: with DNSSEC enabled,
+// only data which was found to be secure or insecure before is returned, unless
+// the client set the CD bit. As negative answers are never marked as such,
+// they are not served stale then. Returns nil if the cache holds nothing usable.
+func (cq *Cq) staleResult(cr *clientRequest) *lookupRes {
+	if cq.cache.StaleWindow() == 0 {
+		return nil
+	}
+
+	q := cr.Query.Questions[0]
+	usable := func(cres *cache.CacheResult) bool {
+		if !cq.validate || cr.Query.Header.CheckingDisabled {
+			return true
+		}
+		return cres.Security == cache.SEC_SECURE || cres.Security == cache.SEC_INSECURE
+	}
+
+	chain := make([]packet.ResourceRecordFormat, 0)
+	security := cache.SEC_SECURE // of the whole chain
+	name := q.Name
+	for i := 0; i <= constants.MAX_CNAME_CHAIN; i++ {
+		cres, cerr := cq.cache.LookupStale(name, q.Type)
+		if cres != nil && cres.Rank >= cache.RANK_ANSWER && usable(cres) {
+			return &lookupRes{&cache.CacheResult{ResourceRecord: append(chain, cres.ResourceRecord...), ResponseCode: cres.ResponseCode, Security: chainStatus(security, cres.Security)}, LR_POSITIVE}
+		}
+		if cerr != nil && len(chain) == 0 && usable(cerr) {
+			return &lookupRes{&cache.CacheResult{ResourceRecord: cerr.ResourceRecord, ResponseCode: cerr.ResponseCode, Security: cerr.Security}, LR_NEGATIVE}
+		}
+		if cres != nil || cerr != nil {
+			break
+		}
+
+		cname, _ := cq.cache.LookupStale(name, constants.TYPE_CNAME)
+		if cname == nil || len(cname.ResourceRecord) != 1 || cname.Rank < cache.RANK_ANSWER || !usable(cname) {
+			break
+		}
+		target, err := packet.ParseName(cname.ResourceRecord[0].Data)
+		if err != nil {
+			break
+		}
+		chain = append(chain, cname.ResourceRecord...)
+		security = chainStatus(security, cname.Security)
+		name = target
+	}
+
+	if len(chain) > 0 {
+		return &lookupRes{&cache.CacheResult{ResourceRecord: chain, ResponseCode: constants.RC_NO_ERR, Security: security}, LR_POSITIVE}
+	}
+	return nil
+}
+
+// chainStatus works like worstStatus, but data which was never validated taints the result
+func chainStatus(a int, b int) int {
+	if a == cache.SEC_UNCHECKED || b == cache.SEC_UNCHECKED {
+		return cache.SEC_UNCHECKED
+	}
+	return worstStatus(a, b)
+}
+
+// staleReply returns the assembled reply to the query of cr carrying stale data
+func (cq *Cq) staleReply(cr *clientRequest, stale *lookupRes) []byte {
+	p := cq.resultReply(cr, stale)
+	p.Header.AuthenticData = authenticData(cr, stale.cres.Security)
+	return packet.AssembleLimited(p, cr.MaxSize)
+}
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStaleSecurity(t *testing.T) {
+	c := cache.NewNameCache()
+	c.SetStaleWindow(time.Hour)
+	sq := NewServerQueue(c)
+	cq := NewClientQueue(c, sq)
+	cq.EnableValidation(nil)
+
+	ns := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	root, _ := packet.ParseTextName(".")
+	pp := readerTestQuery("www.example")
+	sq.registerQuery(pp.Questions[0], ns, &root, false)
+	c.Put(readerTestReply(pp, net.IPv4(192, 0, 2, 80)), ns)
+
+	query := readerTestQuery("www.example")
+	query.Edns = &packet.EdnsOpt{UdpSize: 1232, DnssecOk: true}
+	cr := &clientRequest{Query: query, MaxSize: constants.MAX_SIZE_UDP}
+	cd := &clientRequest{Query: readerTestQuery("www.example"), MaxSize: constants.MAX_SIZE_UDP}
+	cd.Query.Header.CheckingDisabled = true
+
+	// data which was never validated is only returned with CD set
+	if stale := cq.staleResult(cr); stale != nil {
+		panic(fmt.Errorf("Returned unvalidated stale data: %+v", stale.cres))
+	}
+	if stale := cq.staleResult(cd); stale == nil || stale.cres.Security != cache.SEC_UNCHECKED {
+		panic(fmt.Errorf("Expected unvalidated stale data with CD set, got %+v", stale))
+	}
+
+	for _, security := range []int{cache.SEC_SECURE, cache.SEC_INSECURE} {
+		c.SetSecurity(pp.Questions[0].Name, constants.TYPE_A, security)
+		stale := cq.staleResult(cr)
+		if stale == nil || stale.cres.Security != security {
+			panic(fmt.Errorf("Expected stale data with status %d, got %+v", security, stale))
+		}
+		p, err := packet.Parse(cq.staleReply(cr, stale))
+		if err != nil || p.Header.AuthenticData != (security == cache.SEC_SECURE) {
+			panic(fmt.Errorf("Wrong AD bit for status %d: %+v, err=%v", security, p, err))
+		}
+	}
+
+	c.SetSecurity(pp.Questions[0].Name, constants.TYPE_A, cache.SEC_BOGUS)
+	if stale := cq.staleResult(cr); stale != nil {
+		panic(fmt.Errorf("Returned bogus stale data: %+v", stale.cres))
+	}
+	if stale := cq.staleResult(cd); stale == nil || stale.cres.Security != cache.SEC_BOGUS {
+		panic(fmt.Errorf("Expected bogus stale data with CD set, got %+v", stale))
+	}
+}
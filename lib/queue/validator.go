@@ -0,0 +1,350 @@
+package queue
+
+import (
+	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/dnssec"
+	l "github.com/adrian-bl/rna/lib/log"
+	"github.com/adrian-bl/rna/lib/packet"
+	"time"
+)
+
+// EnableValidation turns on DNSSEC validation of all answers, using
+// the given DS records as trust anchors for the root zone
+func (cq *Cq) EnableValidation(anchors []*dnssec.Ds) {
+	cq.anchors = anchors
+	cq.validate = true
+}
+
+// validateResult returns the DNSSEC status of a lookup result (one of cache.SEC_*),
+// along with the RRSIG and NSEC(3) records which may be sent to the client
+func (cq *Cq) validateResult(q packet.QuestionFormat, lres *lookupRes, qctx *qCtx) (int, []packet.ResourceRecordFormat) {
+	switch lres.status {
+	case LR_POSITIVE:
+		status := cache.SEC_SECURE
+		sigs := make([]packet.ResourceRecordFormat, 0)
+		for _, rrset := range splitRRsets(lres.cres.ResourceRecord) {
+			st, rrsigs := cq.validateRRset(rrset, qctx)
+			status = worstStatus(status, st)
+			sigs = append(sigs, rrsigs...)
+		}
+		return status, sigs
+	case LR_NEGATIVE:
+		status := cq.validateDenial(q.Name, q.Type, lres.cres, qctx)
+		return status, lres.cres.Proof
+	}
+	return cache.SEC_BOGUS, nil
+}
+
+// validateRRset returns the DNSSEC status of a cached RRset and its RRSIGs.
+// The result is remembered by the cache, see cache.SetSecurity().
+func (cq *Cq) validateRRset(rrset []packet.ResourceRecordFormat, qctx *qCtx) (int, []packet.ResourceRecordFormat) {
+	name := rrset[0].Name
+	t := rrset[0].Type
+
+	sigs := make([]packet.ResourceRecordFormat, 0)
+	if cres, _ := cq.cache.Lookup(name, constants.TYPE_RRSIG); cres != nil {
+		for _, rr := range cres.ResourceRecord {
+			if sig, err := dnssec.ParseRrsig(rr.Data); err == nil && sig.TypeCovered == t {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+
+	var proof []packet.ResourceRecordFormat
+	if cres, _ := cq.cache.Lookup(name, t); cres != nil {
+		if cres.Security != cache.SEC_UNCHECKED {
+			return cres.Security, sigs
+		}
+		proof = cres.Proof
+	}
+
+	status := cq.verifyRRset(rrset, sigs, proof, qctx)
+	cq.cache.SetSecurity(name, t, status)
+	return status, sigs
+}
+
+// verifyRRset checks the signatures sigs of rrset against the keys of the signing zone.
+// proof must show that no closer match exists if rrset was expanded from a wildcard.
+func (cq *Cq) verifyRRset(rrset []packet.ResourceRecordFormat, sigs []packet.ResourceRecordFormat, proof []packet.ResourceRecordFormat, qctx *qCtx) int {
+	name := rrset[0].Name
+	t := rrset[0].Type
+
+	parsed := dnssec.SignaturesFor(sigs, name, t)
+	if len(parsed) == 0 {
+		return cq.unsignedStatus(name, t, qctx)
+	}
+
+	status := cache.SEC_BOGUS
+	for _, sig := range parsed {
+		// The signer must be the zone holding the data. DS records are signed by the parent.
+		if !name.IsChildOf(&sig.SignerName) || (t == constants.TYPE_DS && name.Len() == sig.SignerName.Len()) {
+			continue
+		}
+		if !cq.isClosestZone(name, t, sig.SignerName) {
+			l.Info("DNSSEC: %v type %d is not served by signer %v", name, t, &sig.SignerName)
+			continue
+		}
+		keys, kstatus := cq.zoneKeys(sig.SignerName, qctx)
+		if kstatus == cache.SEC_INSECURE {
+			status = cache.SEC_INSECURE
+			continue
+		}
+		for _, key := range keys {
+			if err := dnssec.Verify(rrset, sig, key, time.Now()); err == nil {
+				if dnssec.WildcardExpanded(name, sig.Labels) && !cq.noCloserMatch(name, sig, proof, qctx) {
+					return cache.SEC_BOGUS
+				}
+				return cache.SEC_SECURE
+			}
+		}
+	}
+	if status == cache.SEC_BOGUS {
+		l.Info("DNSSEC: no valid signature for %v type %d", name, t)
+	}
+	return status
+}
+
+// noCloserMatch checks that the signed NSEC(3) records in proof show that name
+// was rightfully expanded from the wildcard signed by sig (RFC 4035 5.3.4, RFC 5155 8.8)
+func (cq *Cq) noCloserMatch(name packet.Namelabel, sig *dnssec.Rrsig, proof []packet.ResourceRecordFormat, qctx *qCtx) bool {
+	// only the signing zone may tell us what it does not contain
+	zproof := make([]packet.ResourceRecordFormat, 0)
+	for _, rr := range proof {
+		if rr.Name.IsChildOf(&sig.SignerName) {
+			zproof = append(zproof, rr)
+		}
+	}
+	if err := dnssec.CheckWildcard(name, sig.Labels, zproof); err != nil {
+		l.Info("DNSSEC: invalid wildcard answer for %v: %v", name, err)
+		return false
+	}
+	for _, rrset := range splitRRsets(zproof) {
+		if rrset[0].Type == constants.TYPE_RRSIG {
+			continue
+		}
+		// the proof itself can't be a wildcard expansion: don't pass a proof for it
+		if cq.verifyRRset(rrset, zproof, nil, qctx) != cache.SEC_SECURE {
+			l.Info("DNSSEC: unsigned wildcard proof for %v", name)
+			return false
+		}
+	}
+	return true
+}
+
+// isClosestZone returns false if a known zone cut lies between zone and name, so zone
+// does not serve the records of type t at name. DS and NSEC records at a cut belong to the parent.
+func (cq *Cq) isClosestZone(name packet.Namelabel, t uint16, zone packet.Namelabel) bool {
+	start := 0
+	if t == constants.TYPE_DS || t == constants.TYPE_NSEC {
+		start = 1
+	}
+	for i := start; i < name.Len()-zone.Len(); i++ {
+		if nsrec, _ := cq.cache.Lookup(*name.PoppedLabel(i), constants.TYPE_NS); nsrec != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// zoneKeys returns the validated DNSKEYs of zone. The status is
+// cache.SEC_SECURE if the keys can be trusted.
+func (cq *Cq) zoneKeys(zone packet.Namelabel, qctx *qCtx) ([]*dnssec.Dnskey, int) {
+	dsset := cq.anchors
+	if zone.Len() > 1 {
+		var status int
+		dsset, status = cq.zoneDs(zone, qctx)
+		if status != cache.SEC_SECURE {
+			return nil, status
+		}
+	}
+
+	supported := make([]*dnssec.Ds, 0)
+	for _, ds := range dsset {
+		if dnssec.AlgorithmSupported(ds.Algorithm) && dnssec.DigestSupported(ds.DigestType) {
+			supported = append(supported, ds)
+		}
+	}
+	if len(supported) == 0 {
+		// RFC 4035 5.2: treat the zone as unsigned
+		return nil, cache.SEC_INSECURE
+	}
+
+	lres := cq.resolve(zone, constants.TYPE_DNSKEY, qctx)
+	if lres == nil || lres.status != LR_POSITIVE {
+		l.Info("DNSSEC: no DNSKEY for secure zone %v", zone)
+		return nil, cache.SEC_BOGUS
+	}
+	rrset := lres.cres.ResourceRecord
+
+	keys := make([]*dnssec.Dnskey, 0)
+	for _, rr := range rrset {
+		if key, err := dnssec.ParseDnskey(rr.Data); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	if lres.cres.Security == cache.SEC_SECURE {
+		return keys, cache.SEC_SECURE
+	}
+
+	// The DNSKEY RRset must be signed by a key referenced by the DS set
+	sigs := make([]packet.ResourceRecordFormat, 0)
+	if cres, _ := cq.cache.Lookup(zone, constants.TYPE_RRSIG); cres != nil {
+		sigs = cres.ResourceRecord
+	}
+	for _, sig := range dnssec.SignaturesFor(sigs, zone, constants.TYPE_DNSKEY) {
+		for _, key := range keys {
+			if !dsMatches(supported, zone, key) {
+				continue
+			}
+			if err := dnssec.Verify(rrset, sig, key, time.Now()); err == nil {
+				cq.cache.SetSecurity(zone, constants.TYPE_DNSKEY, cache.SEC_SECURE)
+				return keys, cache.SEC_SECURE
+			}
+		}
+	}
+	l.Info("DNSSEC: DNSKEY set of %v does not match its DS records", zone)
+	return nil, cache.SEC_BOGUS
+}
+
+// zoneDs returns the validated DS records of zone, as served by its parent.
+// A provably missing DS set results in cache.SEC_INSECURE.
+func (cq *Cq) zoneDs(zone packet.Namelabel, qctx *qCtx) ([]*dnssec.Ds, int) {
+	lres := cq.resolve(zone, constants.TYPE_DS, qctx)
+	if lres == nil {
+		return nil, cache.SEC_BOGUS
+	}
+
+	switch lres.status {
+	case LR_POSITIVE:
+		rrset := make([]packet.ResourceRecordFormat, 0)
+		for _, rr := range lres.cres.ResourceRecord {
+			if rr.Type == constants.TYPE_DS {
+				rrset = append(rrset, rr)
+			}
+		}
+		if len(rrset) == 0 {
+			return nil, cache.SEC_BOGUS
+		}
+		status, _ := cq.validateRRset(rrset, qctx)
+		if status != cache.SEC_SECURE {
+			return nil, status
+		}
+		dsset := make([]*dnssec.Ds, 0)
+		for _, rr := range rrset {
+			if ds, err := dnssec.ParseDs(rr.Data); err == nil {
+				dsset = append(dsset, ds)
+			}
+		}
+		return dsset, cache.SEC_SECURE
+	case LR_NEGATIVE:
+		if cq.validateDenial(zone, constants.TYPE_DS, lres.cres, qctx) == cache.SEC_BOGUS {
+			return nil, cache.SEC_BOGUS
+		}
+		// no DS records: this is an unsigned delegation
+		return nil, cache.SEC_INSECURE
+	}
+	return nil, cache.SEC_BOGUS
+}
+
+// validateDenial checks the NSEC(3) proof of a negative cache result
+func (cq *Cq) validateDenial(qname packet.Namelabel, qtype uint16, cres *cache.CacheResult, qctx *qCtx) int {
+	proof := cres.Proof
+	if len(proof) == 0 {
+		return cq.unsignedStatus(qname, qtype, qctx)
+	}
+
+	// all NSEC(3) RRsets and the SOA must carry valid signatures
+	rrsets := splitRRsets(append(cres.ResourceRecord, proof...))
+	for _, rrset := range rrsets {
+		if rrset[0].Type == constants.TYPE_RRSIG {
+			continue
+		}
+		switch status := cq.verifyRRset(rrset, proof, nil, qctx); status {
+		case cache.SEC_SECURE:
+		case cache.SEC_INSECURE:
+			return status
+		default:
+			l.Info("DNSSEC: unsigned denial record for %v type %d", qname, qtype)
+			return cache.SEC_BOGUS
+		}
+	}
+
+	optOut, err := dnssec.CheckDenial(qname, qtype, cres.ResponseCode == constants.RC_NAME_ERR, proof)
+	if err != nil {
+		l.Info("DNSSEC: invalid denial of %v type %d: %v", qname, qtype, err)
+		return cache.SEC_BOGUS
+	}
+	if optOut {
+		return cache.SEC_INSECURE
+	}
+	return cache.SEC_SECURE
+}
+
+// unsignedStatus checks if unsigned data of type t at name is acceptable:
+// this is the case if the closest known zone cut is an unsigned delegation
+func (cq *Cq) unsignedStatus(name packet.Namelabel, t uint16, qctx *qCtx) int {
+	start := 0
+	if t == constants.TYPE_DS {
+		start = 1 // DS records are owned by the parent zone
+	}
+
+	for i := start; i < name.Len()-1; i++ {
+		label := name.PoppedLabel(i)
+		if nsrec, _ := cq.cache.Lookup(*label, constants.TYPE_NS); nsrec == nil {
+			continue
+		}
+		_, status := cq.zoneDs(*label, qctx)
+		if status == cache.SEC_SECURE {
+			// this is a signed zone
+			break
+		}
+		return status
+	}
+	l.Info("DNSSEC: unsigned data for %v in a secure zone", name)
+	return cache.SEC_BOGUS
+}
+
+// resolve runs a blocking lookup of name and type t
+func (cq *Cq) resolve(name packet.Namelabel, t uint16, qctx *qCtx) *lookupRes {
+	c := make(chan *lookupRes)
+	go cq.collapsedLookup(packet.QuestionFormat{Name: name, Type: t, Class: constants.CLASS_IN}, c, qctx)
+	return <-c
+}
+
+// splitRRsets groups records by their owner name and type, keeping the order of first appearance
+func splitRRsets(rrs []packet.ResourceRecordFormat) [][]packet.ResourceRecordFormat {
+	result := make([][]packet.ResourceRecordFormat, 0)
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		key := (&putCbItem{Key: rr.Name.ToKey(), Type: rr.Type}).ToString()
+		if i, ok := index[key]; ok {
+			result[i] = append(result[i], rr)
+		} else {
+			index[key] = len(result)
+			result = append(result, []packet.ResourceRecordFormat{rr})
+		}
+	}
+	return result
+}
+
+// dsMatches returns true if any of dsset references key
+func dsMatches(dsset []*dnssec.Ds, zone packet.Namelabel, key *dnssec.Dnskey) bool {
+	for _, ds := range dsset {
+		if ds.Matches(zone, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// worstStatus combines two DNSSEC states: bogus beats insecure beats secure
+func worstStatus(a int, b int) int {
+	if a == cache.SEC_BOGUS || b == cache.SEC_BOGUS {
+		return cache.SEC_BOGUS
+	}
+	if a == cache.SEC_INSECURE || b == cache.SEC_INSECURE {
+		return cache.SEC_INSECURE
+	}
+	return cache.SEC_SECURE
+}
@@ -0,0 +1,151 @@
+package queue
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/adrian-bl/rna/lib/cache"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/dnssec"
+	"github.com/adrian-bl/rna/lib/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsClosestZone(t *testing.T) {
+	cq := nsTestQueue()
+	ns := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	root, _ := packet.ParseTextName(".")
+	zone, _ := packet.ParseTextName("example.com")
+	sub, _ := packet.ParseTextName("sub.example.com")
+	name, _ := packet.ParseTextName("www.sub.example.com")
+
+	// referrals to example.com and from there to sub.example.com
+	q := packet.QuestionFormat{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN}
+	for _, cut := range []packet.Namelabel{zone, sub} {
+		cq.sq.registerQuery(q, ns, &root, false)
+		referral := &packet.ParsedPacket{Questions: []packet.QuestionFormat{q}}
+		referral.Header.Response = true
+		nsname := append([]byte{2, 'n', 's'}, packet.EncodeName(cut)...)
+		referral.Nameservers = []packet.ResourceRecordFormat{{Name: cut, Type: constants.TYPE_NS, Class: constants.CLASS_IN, Ttl: 300, Data: nsname}}
+		cq.cache.Put(referral, ns)
+	}
+
+	if cq.isClosestZone(name, constants.TYPE_A, zone) {
+		panic(fmt.Errorf("example.com must not sign data below the cut at sub.example.com"))
+	}
+	if !cq.isClosestZone(name, constants.TYPE_A, sub) {
+		panic(fmt.Errorf("sub.example.com must sign its own data"))
+	}
+	for _, t := range []uint16{constants.TYPE_DS, constants.TYPE_NSEC} {
+		if !cq.isClosestZone(sub, t, zone) || cq.isClosestZone(sub, t, root) {
+			panic(fmt.Errorf("Type %d at the cut must be signed by the parent", t))
+		}
+	}
+	if cq.isClosestZone(sub, constants.TYPE_SOA, zone) {
+		panic(fmt.Errorf("The apex of sub.example.com must not be signed by its parent"))
+	}
+}
+
+// signer creates DNSSEC signatures made by the root zone
+type testSigner struct {
+	priv   ed25519.PrivateKey
+	dnskey []byte
+	tag    uint16
+}
+
+func newTestSigner() *testSigner {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	ts := &testSigner{priv: priv, dnskey: append([]byte{0x01, 0x01, 3, dnssec.ALG_ED25519}, pub...)}
+	key, _ := dnssec.ParseDnskey(ts.dnskey)
+	ts.tag = key.KeyTag()
+	return ts
+}
+
+// anchor returns the DS record of the root key
+func (ts *testSigner) anchor() *dnssec.Ds {
+	digest := sha256.Sum256(append([]byte{0}, ts.dnskey...))
+	return &dnssec.Ds{KeyTag: ts.tag, Algorithm: dnssec.ALG_ED25519, DigestType: dnssec.DIGEST_SHA256, Digest: digest[:]}
+}
+
+// sign returns an RRSIG over the single record rr, signing owner (which differs for wildcards)
+func (ts *testSigner) sign(rr packet.ResourceRecordFormat, owner string, labels uint8) packet.ResourceRecordFormat {
+	now := uint32(time.Now().Unix())
+	rdata := make([]byte, 18)
+	binary.BigEndian.PutUint16(rdata[0:], rr.Type)
+	rdata[2] = dnssec.ALG_ED25519
+	rdata[3] = labels
+	binary.BigEndian.PutUint32(rdata[4:], rr.Ttl)
+	binary.BigEndian.PutUint32(rdata[8:], now+3600)
+	binary.BigEndian.PutUint32(rdata[12:], now-3600)
+	binary.BigEndian.PutUint16(rdata[16:], ts.tag)
+	rdata = append(rdata, 0) // signed by the root
+
+	on, _ := packet.ParseTextName(owner)
+	data := append([]byte{}, rdata...)
+	data = append(data, packet.EncodeName(on)...)
+	data = append(data, byte(rr.Type>>8), byte(rr.Type), byte(rr.Class>>8), byte(rr.Class))
+	data = append(data, rdata[4:8]...)
+	data = append(data, byte(len(rr.Data)>>8), byte(len(rr.Data)))
+	data = append(data, rr.Data...)
+	return packet.ResourceRecordFormat{Name: rr.Name, Type: constants.TYPE_RRSIG, Class: constants.CLASS_IN, Ttl: rr.Ttl, Data: append(rdata, ed25519.Sign(ts.priv, data)...)}
+}
+
+// validatorTestPut caches an authoritative reply to a query for name
+func validatorTestPut(cq *Cq, name packet.Namelabel, t uint16, answers []packet.ResourceRecordFormat, authority []packet.ResourceRecordFormat) {
+	ns := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	root, _ := packet.ParseTextName(".")
+	q := packet.QuestionFormat{Name: name, Type: t, Class: constants.CLASS_IN}
+	cq.sq.registerQuery(q, ns, &root, false)
+	p := &packet.ParsedPacket{Questions: []packet.QuestionFormat{q}, Answers: answers, Nameservers: authority}
+	p.Header.Response = true
+	p.Header.Authoritative = true
+	cq.cache.Put(p, ns)
+}
+
+// validatorTestNsec returns an NSEC record of the root zone owned by owner, pointing to next
+func validatorTestNsec(owner string, next string) packet.ResourceRecordFormat {
+	on, _ := packet.ParseTextName(owner)
+	nn, _ := packet.ParseTextName(next)
+	data := append(packet.EncodeName(nn), 0, 6, 0, 0, 0, 0, 0, 0x03) // RRSIG and NSEC
+	return packet.ResourceRecordFormat{Name: on, Type: constants.TYPE_NSEC, Class: constants.CLASS_IN, Ttl: 300, Data: data}
+}
+
+func TestWildcardProof(t *testing.T) {
+	ts := newTestSigner()
+	cq := nsTestQueue()
+	cq.EnableValidation([]*dnssec.Ds{ts.anchor()})
+
+	root, _ := packet.ParseTextName(".")
+	dnskey := packet.ResourceRecordFormat{Name: root, Type: constants.TYPE_DNSKEY, Class: constants.CLASS_IN, Ttl: 300, Data: ts.dnskey}
+	validatorTestPut(cq, root, constants.TYPE_DNSKEY, []packet.ResourceRecordFormat{dnskey, ts.sign(dnskey, ".", 0)}, nil)
+
+	for _, c := range []struct {
+		name   string
+		proof  []packet.ResourceRecordFormat
+		signed bool
+		status int
+	}{
+		{"plain.test", nil, true, cache.SEC_BOGUS}, // no proof at all
+		{"b.test", []packet.ResourceRecordFormat{validatorTestNsec("a.test", "c.test")}, false, cache.SEC_BOGUS},
+		{"bar.test", []packet.ResourceRecordFormat{validatorTestNsec("a.test", "b.test")}, true, cache.SEC_BOGUS},
+		{"foo.test", []packet.ResourceRecordFormat{validatorTestNsec("a.test", "z.test")}, true, cache.SEC_SECURE},
+	} {
+		name, _ := packet.ParseTextName(c.name)
+		a := packet.ResourceRecordFormat{Name: name, Type: constants.TYPE_A, Class: constants.CLASS_IN, Ttl: 300, Data: []byte{192, 0, 2, 1}}
+		authority := c.proof
+		for _, rr := range c.proof {
+			if c.signed {
+				authority = append(authority, ts.sign(rr, rr.Name.String(), 2))
+			}
+		}
+		validatorTestPut(cq, name, constants.TYPE_A, []packet.ResourceRecordFormat{a, ts.sign(a, "*.test", 1)}, authority)
+
+		if status, _ := cq.validateRRset([]packet.ResourceRecordFormat{a}, newQCtx(time.Now().Add(time.Second))); status != c.status {
+			panic(fmt.Errorf("Expected status %d for %s, got %d", c.status, c.name, status))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"github.com/adrian-bl/rna/lib/packet"
+	"github.com/adrian-bl/rna/lib/zone"
+	"net"
+)
+
+// A zone whose queries are sent to a fixed set of servers
+type zoneServers struct {
+	zone    packet.Namelabel
+	servers []nsCandidate
+}
+
+func newZoneServers(zone packet.Namelabel, servers []*net.UDPAddr) *zoneServers {
+	zs := &zoneServers{zone: zone}
+	for _, s := range servers {
+		zs.servers = append(zs.servers, nsCandidate{addr: s.String()})
+	}
+	return zs
+}
+
+// AddForwardZone sends all queries for names in zone to the given resolvers
+// instead of walking the delegations. The most specific zone wins.
+func (cq *Cq) AddForwardZone(zone packet.Namelabel, servers []*net.UDPAddr) {
+	cq.forwarders[zone.ToKey()] = newZoneServers(zone, servers)
+}
+
+// AddStubZone uses the given authoritative servers for zone, ignoring its
+// public delegation. Delegations below zone are still followed.
+func (cq *Cq) AddStubZone(zone packet.Namelabel, servers []*net.UDPAddr) {
+	cq.stubs[zone.ToKey()] = newZoneServers(zone, servers)
+}
+
+// AddLocalZone answers all queries for names in z from its data
+func (cq *Cq) AddLocalZone(z *zone.Zone) {
+	cq.localZones.Add(z)
+}
+
+// forwardZone returns the most specific forward zone of name, nil if none is configured
+func (cq *Cq) forwardZone(name packet.Namelabel) *zoneServers {
+	for i := 0; i < name.Len(); i++ {
+		if fz := cq.forwarders[name.PoppedLabel(i).ToKey()]; fz != nil {
+			return fz
+		}
+	}
+	return nil
+}
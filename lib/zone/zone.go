@@ -0,0 +1,170 @@
+package zone
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"sync"
+)
+
+// Zone holds the data of a zone we answer authoritatively
+type Zone struct {
+	Origin  packet.Namelabel
+	soa     packet.ResourceRecordFormat
+	minimum uint32                                              // SOA minimum, caps the TTL of negative answers
+	records map[string]map[uint16][]packet.ResourceRecordFormat // records by owner and type
+	nodes   map[string]bool                                     // all existing names, including empty non-terminals
+}
+
+// The reply to a question for local data
+type Answer struct {
+	Rcode     uint8
+	Answers   []packet.ResourceRecordFormat
+	Authority []packet.ResourceRecordFormat
+}
+
+// New creates a zone with given origin from rrs, which must contain exactly one
+// SOA at the apex. Delegations are not supported: use stub zones instead.
+func New(origin packet.Namelabel, rrs []packet.ResourceRecordFormat) (*Zone, error) {
+	z := &Zone{Origin: origin, records: make(map[string]map[uint16][]packet.ResourceRecordFormat), nodes: make(map[string]bool)}
+	apex := origin.ToKey()
+	soas := 0
+
+	for _, rr := range rrs {
+		if !rr.Name.IsChildOf(&origin) {
+			return nil, fmt.Errorf("%v is outside of zone %v", &rr.Name, &origin)
+		}
+		key := rr.Name.ToKey()
+		switch {
+		case rr.Type == constants.TYPE_SOA && key == apex:
+			soa, err := packet.ParseRdata(rr.Type, rr.Data)
+			if err != nil {
+				return nil, err
+			}
+			z.soa = rr
+			z.minimum = soa.(*packet.RdataSoa).Minimum
+			soas++
+		case rr.Type == constants.TYPE_SOA:
+			return nil, fmt.Errorf("SOA record for %v is not at the apex", &rr.Name)
+		case rr.Type == constants.TYPE_NS && key != apex:
+			return nil, fmt.Errorf("Delegation of %v is not supported", &rr.Name)
+		}
+
+		if z.records[key] == nil {
+			z.records[key] = make(map[uint16][]packet.ResourceRecordFormat)
+		}
+		z.records[key][rr.Type] = append(z.records[key][rr.Type], rr)
+		for i := 0; i <= rr.Name.Len()-origin.Len(); i++ {
+			z.nodes[rr.Name.PoppedLabel(i).ToKey()] = true
+		}
+	}
+	if soas != 1 {
+		return nil, fmt.Errorf("Zone %v must have exactly one SOA record, got %d", &origin, soas)
+	}
+	for key, types := range z.records {
+		if _, ok := types[constants.TYPE_CNAME]; ok && len(types) > 1 {
+			return nil, fmt.Errorf("CNAME at %s may not have other data", key)
+		}
+	}
+	return z, nil
+}
+
+// Load reads the zone with given origin from a master file
+func Load(path string, origin packet.Namelabel) (*Zone, error) {
+	rrs, err := packet.ParseZoneFile(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	return New(origin, rrs)
+}
+
+// Lookup answers q from the zone data. CNAMEs are followed as long as
+// their target is inside of this zone.
+func (z *Zone) Lookup(q packet.QuestionFormat) *Answer {
+	a := &Answer{Rcode: constants.RC_NO_ERR}
+	name := q.Name
+
+	for i := 0; i <= constants.MAX_CNAME_CHAIN; i++ {
+		key := name.ToKey()
+		if !z.nodes[key] {
+			a.Rcode = constants.RC_NAME_ERR
+			a.Authority = append(a.Authority, z.negativeSoa())
+			return a
+		}
+
+		types := z.records[key]
+		if rrs := types[q.Type]; len(rrs) > 0 {
+			a.Answers = append(a.Answers, withName(rrs, name)...)
+			return a
+		}
+		cname := types[constants.TYPE_CNAME]
+		if len(cname) == 0 {
+			// the name exists, but not with this type (or is an empty non-terminal)
+			a.Authority = append(a.Authority, z.negativeSoa())
+			return a
+		}
+
+		a.Answers = append(a.Answers, withName(cname, name)...)
+		target, err := packet.ParseName(cname[0].Data)
+		if err != nil || !target.IsChildOf(&z.Origin) {
+			// the client has to resolve the target on its own
+			return a
+		}
+		name = target
+	}
+	return a
+}
+
+// negativeSoa returns the SOA to include in negative answers,
+// its TTL limits how long they may be cached (RFC 2308 3)
+func (z *Zone) negativeSoa() packet.ResourceRecordFormat {
+	soa := z.soa
+	if z.minimum < soa.Ttl {
+		soa.Ttl = z.minimum
+	}
+	return soa
+}
+
+// withName returns a copy of rrs using the case of name as owner
+func withName(rrs []packet.ResourceRecordFormat, name packet.Namelabel) []packet.ResourceRecordFormat {
+	result := make([]packet.ResourceRecordFormat, len(rrs))
+	for i, rr := range rrs {
+		rr.Name = name
+		result[i] = rr
+	}
+	return result
+}
+
+// Store holds all zones we answer authoritatively
+type Store struct {
+	sync.RWMutex
+	zones map[string]*Zone
+}
+
+func NewStore() *Store {
+	return &Store{zones: make(map[string]*Zone)}
+}
+
+// Add adds z to the store, replacing any zone with the same origin
+func (s *Store) Add(z *Zone) {
+	s.Lock()
+	defer s.Unlock()
+	s.zones[z.Origin.ToKey()] = z
+}
+
+// Lookup answers q using the most specific zone enclosing its name.
+// Returns nil if the name is not part of any local zone.
+func (s *Store) Lookup(q packet.QuestionFormat) *Answer {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.zones) == 0 {
+		return nil
+	}
+	// Len() includes the root label: the last iteration looks up the root zone
+	for i := 0; i < q.Name.Len(); i++ {
+		if z := s.zones[q.Name.PoppedLabel(i).ToKey()]; z != nil {
+			return z.Lookup(q)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package zone
+
+import (
+	"fmt"
+	"github.com/adrian-bl/rna/lib/constants"
+	"github.com/adrian-bl/rna/lib/packet"
+	"strings"
+	"testing"
+)
+
+const testZone = `
+@         3600 SOA   ns hostmaster 1 7200 900 1209600 300
+          3600 NS    ns
+ns        3600 A     192.0.2.1
+www            CNAME ns
+ext            CNAME www.example.net.
+a.b            A     192.0.2.2
+`
+
+func newTestStore() *Store {
+	origin, _ := packet.ParseTextName("example.com")
+	rrs, err := packet.ParseZone(strings.NewReader(testZone), origin)
+	if err != nil {
+		panic(err)
+	}
+	z, err := New(origin, rrs)
+	if err != nil {
+		panic(err)
+	}
+	s := NewStore()
+	s.Add(z)
+	return s
+}
+
+func testLookup(s *Store, name string, t uint16) *Answer {
+	n, _ := packet.ParseTextName(name)
+	return s.Lookup(packet.QuestionFormat{Name: n, Type: t, Class: constants.CLASS_IN})
+}
+
+func TestLookup(t *testing.T) {
+	s := newTestStore()
+
+	if a := testLookup(s, "NS.example.com", constants.TYPE_A); a.Rcode != constants.RC_NO_ERR || len(a.Answers) != 1 || a.Answers[0].Name.String() != "NS.example.com." {
+		panic(fmt.Errorf("Unexpected positive answer: %+v", a))
+	}
+	if a := testLookup(s, "www.example.com", constants.TYPE_A); len(a.Answers) != 2 || a.Answers[1].Type != constants.TYPE_A {
+		panic(fmt.Errorf("CNAME was not followed: %+v", a))
+	}
+	if a := testLookup(s, "ext.example.com", constants.TYPE_A); len(a.Answers) != 1 || len(a.Authority) != 0 {
+		panic(fmt.Errorf("Expected an unresolved CNAME: %+v", a))
+	}
+	if a := testLookup(s, "other.example.net", constants.TYPE_A); a != nil {
+		panic(fmt.Errorf("Answered a name outside of all zones: %+v", a))
+	}
+}
+
+func TestNegativeLookup(t *testing.T) {
+	s := newTestStore()
+
+	for _, name := range []string{"ns.example.com", "b.example.com"} {
+		a := testLookup(s, name, constants.TYPE_MX)
+		if a.Rcode != constants.RC_NO_ERR || len(a.Answers) != 0 || len(a.Authority) != 1 || a.Authority[0].Ttl != 300 {
+			panic(fmt.Errorf("Expected NODATA for %s: %+v", name, a))
+		}
+	}
+	a := testLookup(s, "missing.example.com", constants.TYPE_A)
+	if a.Rcode != constants.RC_NAME_ERR || len(a.Authority) != 1 || a.Authority[0].Type != constants.TYPE_SOA {
+		panic(fmt.Errorf("Expected NXDOMAIN: %+v", a))
+	}
+}
+
+func TestRootZone(t *testing.T) {
+	origin, _ := packet.ParseTextName(".")
+	rrs, err := packet.ParseZone(strings.NewReader("@ 3600 SOA ns hostmaster 1 7200 900 1209600 300\n@ 3600 NS ns\nns 3600 A 192.0.2.1\n"), origin)
+	if err != nil {
+		panic(err)
+	}
+	z, err := New(origin, rrs)
+	if err != nil {
+		panic(err)
+	}
+	s := NewStore()
+	s.Add(z)
+
+	if a := testLookup(s, ".", constants.TYPE_SOA); a == nil || len(a.Answers) != 1 || a.Answers[0].Name.Len() != 1 {
+		panic(fmt.Errorf("Expected the SOA of the root zone: %+v", a))
+	}
+	if a := testLookup(s, "ns", constants.TYPE_A); a == nil || len(a.Answers) != 1 {
+		panic(fmt.Errorf("Expected the address of ns: %+v", a))
+	}
+	if a := testLookup(s, "missing.example", constants.TYPE_A); a == nil || a.Rcode != constants.RC_NAME_ERR {
+		panic(fmt.Errorf("Expected NXDOMAIN below the root zone: %+v", a))
+	}
+}
+
+func TestInvalidZone(t *testing.T) {
+	origin, _ := packet.ParseTextName("example.com")
+	for _, bad := range []string{
+		"x 60 A 192.0.2.1\n",
+		"@ 60 SOA ns hm 1 2 3 4 5\nx.example.net. 60 A 192.0.2.1\n",
+		"@ 60 SOA ns hm 1 2 3 4 5\nsub 60 NS ns\n",
+		"@ 60 SOA ns hm 1 2 3 4 5\nx 60 CNAME y\nx 60 A 192.0.2.1\n",
+	} {
+		rrs, err := packet.ParseZone(strings.NewReader(bad), origin)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := New(origin, rrs); err == nil {
+			panic(fmt.Errorf("Expected %q to be rejected", bad))
+		}
+	}
+}